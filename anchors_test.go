@@ -0,0 +1,225 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSlugOf(t *testing.T) {
+	data := []struct {
+		text string
+		exp  string
+	}{
+		{"Parsing", "parsing"},
+		{"Reading the markup", "reading-the-markup"},
+		{"  Spaced   out  ", "spaced-out"},
+		{"Don't panic!", "dont-panic"},
+		{"a b", "a-b"},
+		{"a-b", "a-b"},
+		{"snake_case - and more", "snake-case-and-more"},
+		{"Ünïcode café", "ünïcode-café"},
+		{"Version 1.2", "version-12"},
+		{"!!!", "section"},
+		{"", "section"},
+	}
+
+	for _, d := range data {
+		slug := slugOf(d.text, "section")
+		if slug != d.exp {
+			t.Errorf("Text %q: Expected slug %q but got %q", d.text, d.exp, slug)
+		}
+	}
+}
+
+func TestClaim(t *testing.T) {
+	taken := map[string]string{"section-1": "section-1"}
+
+	data := []struct {
+		slug  string
+		owner string
+		exp   string
+	}{
+		{"parsing", "section-2", "parsing"},
+		{"parsing", "section-3", "parsing-1"},
+		{"parsing", "@{parsing}", "parsing-2"},
+		{"parsing", "section-3", "parsing-1"},
+		{"section-1", "section-4", "section-1-1"},
+		{"section-1", "section-1", "section-1"},
+	}
+
+	for _, d := range data {
+		slug := claim(taken, d.slug, d.owner)
+		if slug != d.exp {
+			t.Errorf("Claiming %q for %q: Expected %q but got %q",
+				d.slug, d.owner, d.exp, slug)
+		}
+	}
+}
+
+func anchorsTestDoc(t *testing.T, anchors string) (state, doc) {
+	data := map[string]string{
+		"book.md": "# Introduction\n" + // 1
+			"@contents\n" + // 2
+			"* [Parsing](parsing.md)\n" + // 3
+			"## Parsing\n" + // 4
+			"``` a b\n" + // 5
+			"one\n" + // 6
+			"```\n" + // 7
+			"``` a-b\n" + // 8
+			"two\n" + // 9
+			"```\n", // 10
+		"parsing.md": "``` a b\n" + // 1
+			"three\n" + // 2
+			"```\n" + // 3
+			"## Parsing\n" + // 4
+			"## Section 1\n" + // 5
+			"## The parser {#intro}\n" + // 6
+			"``` Parsing\n" + // 7
+			"@{a-b}\n" + // 8
+			"```\n", // 9
+	}
+
+	s := newState()
+	s.setFirstInName("book.md")
+	s.book = "book.md"
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		return stringReadCloser{strings.NewReader(data[fName])}, nil
+	}
+	d := newDoc()
+	d.anchors = anchors
+
+	if err := firstPassForAll(&s, &d); err != nil {
+		t.Fatalf("Error on first pass for all: %s", err.Error())
+	}
+	d.lat = compileLattice(d.chunks)
+	return s, d
+}
+
+func TestMakeSlugs(t *testing.T) {
+	_, d := anchorsTestDoc(t, "text")
+
+	expSlugs := map[string]map[string]string{
+		"book.md": map[string]string{
+			"section-1":   "introduction",
+			"section-1.1": "parsing",
+		},
+		"parsing.md": map[string]string{
+			"section-1.1": "parsing",
+			"section-1.2": "parsing-1",
+			"section-1.3": "section-1",
+			"section-1.4": "intro",
+		},
+	}
+	for inName, exp := range expSlugs {
+		if len(d.slugs[inName]) != len(exp) {
+			t.Errorf("Expected slugs for %s to be %#v but got %#v",
+				inName, exp, d.slugs[inName])
+		}
+		for anchor, slug := range exp {
+			if d.slugs[inName][anchor] != slug {
+				t.Errorf("Expected slug of %s in %s to be %q but got %q",
+					anchor, inName, slug, d.slugs[inName][anchor])
+			}
+		}
+	}
+
+	expChunkSlugs := map[string]string{
+		"a b":     "a-b-1",
+		"a-b":     "a-b-2",
+		"Parsing": "parsing-2",
+	}
+	if len(d.chunkSlugs) != len(expChunkSlugs) {
+		t.Errorf("Expected chunk slugs %#v but got %#v", expChunkSlugs, d.chunkSlugs)
+	}
+	for name, slug := range expChunkSlugs {
+		if d.chunkSlugs[name] != slug {
+			t.Errorf("Expected slug of chunk %q to be %q but got %q",
+				name, slug, d.chunkSlugs[name])
+		}
+	}
+
+	// Later definitions follow on from the first
+	expDefSlugs := map[string]map[int]string{"a b": {1: "a-b-1-2"}}
+	if !reflect.DeepEqual(d.defSlugs, expDefSlugs) {
+		t.Errorf("Expected definition slugs %#v but got %#v", expDefSlugs, d.defSlugs)
+	}
+}
+
+func TestFinalMarkdown_TextAnchors(t *testing.T) {
+	_, d := anchorsTestDoc(t, "text")
+
+	expected := map[string][]string{
+		"book.md": []string{
+			"# <a id=\"introduction\"></a><a name=\"section-1\"></a>1 Introduction\n",
+			"* [1.4 The parser](parsing.html#intro)\n",
+			"## <a id=\"parsing\"></a><a name=\"section-1.1\"></a>1.1 Parsing\n",
+			"<a id=\"a-b-1\"></a><a name=\"a-b\"></a>a b <span class=\"chunk-cont\">" +
+				"continued in <a href=\"parsing.html#a-b-1-2\">§1.1</a></span>\n",
+			"<a id=\"a-b-2\"></a><a name=\"a-b\"></a>a-b\n",
+			"Added to in section [1.1](parsing.html#parsing).",
+			"Used in section [1.4](parsing.html#intro).",
+		},
+		"parsing.md": []string{
+			"<a id=\"parsing\"></a><a name=\"section-1.1\"></a>\n",
+			"## <a id=\"section-1\"></a><a name=\"section-1.3\"></a>1.3 Section 1\n",
+			"<a id=\"parsing-2\"></a><a name=\"Parsing\"></a>Parsing\n",
+			"<a id=\"a-b-1-2\"></a><a name=\"a-b_2\"></a>a b <span class=\"chunk-cont\">" +
+				"continued from <a href=\"book.html#a-b-1\">§1.1</a></span>\n",
+		},
+	}
+	for inName, subs := range expected {
+		mdown := finalMarkdown(inName, &d).String()
+		for _, sub := range subs {
+			if !strings.Contains(mdown, sub) {
+				t.Errorf("Expected markdown for %s to contain %q but got\n%s",
+					inName, sub, mdown)
+			}
+		}
+	}
+
+	link := htmlLink("a-b", &d, "parsing.md", "@{a-b}")
+	expLink := `<a href="book.html#parsing">@{a-b}</a>`
+	if link != expLink {
+		t.Errorf("Expected chunk link %q but got %q", expLink, link)
+	}
+}
+
+func TestFinalMarkdown_NumberedAnchors(t *testing.T) {
+	_, d := anchorsTestDoc(t, "numbers")
+
+	if len(d.slugs) != 0 || len(d.chunkSlugs) != 0 {
+		t.Errorf("Expected no slugs but got %#v and %#v", d.slugs, d.chunkSlugs)
+	}
+
+	mdown := finalMarkdown("book.md", &d).String()
+	for _, sub := range []string{
+		"# <a name=\"section-1\"></a>1 Introduction\n",
+		"* [1.4 The parser](parsing.html#section-1.4)\n",
+		"<a name=\"a-b\"></a>a-b\n",
+	} {
+		if !strings.Contains(mdown, sub) {
+			t.Errorf("Expected markdown to contain %q but got\n%s", sub, mdown)
+		}
+	}
+	if strings.Contains(mdown, "<a id=") {
+		t.Errorf("Expected no text anchors but got\n%s", mdown)
+	}
+}
+
+func TestProcForAnchorsDirective(t *testing.T) {
+	s := newState()
+	s.setFirstInName("anchors.md")
+	d := newDoc()
+
+	s.proc(&s, &d, "@anchors words")
+	s.proc(&s, &d, "@anchors text")
+
+	if d.anchors != "text" {
+		t.Errorf("Expected text anchors but got %q", d.anchors)
+	}
+	if len(s.warnings) != 1 || s.warnings[0].line != 1 {
+		t.Errorf("Expected one warning at line 1 but got %#v", s.warnings)
+	}
+}
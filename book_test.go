@@ -189,7 +189,7 @@ func TestFirstPassForAll_PreservesSectionForNewChapter(t *testing.T) {
 	}
 	var sec section
 	secSet := false
-	secExp := section{"second.md", []int{2, 1}, "Section 2.1"}
+	secExp := section{inName: "second.md", nums: []int{2, 1}, text: "Section 2.1"}
 	procOrig := s.proc
 	s.proc = func(s *state, d *doc, line string) {
 		if !secSet && s.inName == "second.md" {
@@ -298,30 +298,301 @@ func TestFirstPassForAll_ErrorsIfInChunkAtEndOfFile(t *testing.T) {
 	}
 }
 
-func TestMarkdownLink(t *testing.T) {
+func TestMarkdownLinks(t *testing.T) {
 	data := []struct {
-		line string
-		link string
+		line  string
+		links []string
 	}{
-		{"", ""},
-		{"no.md", ""},
-		{"...](some/file.md)...", "some/file.md"},
-		{"...](some/file.md#anchor)...", "some/file.md"},
-		{"...](some/file.md#1234)...", "some/file.md"},
-		{"...](some/file.md#2-3.4)...", "some/file.md"},
-		{"...](some/file.md#anchor.md)...", "some/file.md"},
-		{"...](some/file#anchor.md)...", ""},
-		{"...](some/file.md...", ""},
-		{"...](some/file.md \"Title\")", "some/file.md"},
-		{"...](some/file.md#a2 \"Title\")", "some/file.md"},
-		{"...](some/file.txt)...", ""},
+		{"", []string{}},
+		{"no.md", []string{}},
+		{"...](some/file.md)...", []string{"some/file.md"}},
+		{"...](some/file.md#anchor)...", []string{"some/file.md"}},
+		{"...](some/file.md#1234)...", []string{"some/file.md"}},
+		{"...](some/file.md#2-3.4)...", []string{"some/file.md"}},
+		{"...](some/file.md#anchor.md)...", []string{"some/file.md"}},
+		{"...](some/file#anchor.md)...", []string{}},
+		{"...](some/file.md...", []string{}},
+		{"...](some/file.md \"Title\")", []string{"some/file.md"}},
+		{"...](some/file.md#a2 \"Title\")", []string{"some/file.md"}},
+		{"...](some/file.txt)...", []string{}},
+		{"...](some/file.lit)...", []string{"some/file.lit"}},
+		{"...](some/file.nw#anchor)...", []string{"some/file.nw"}},
+		{"[a](a.md) and [b](b/b.md)", []string{"a.md", "b/b.md"}},
+		{"[a](a.txt) and [b](b.md)", []string{"b.md"}},
+		{"...](http://example.com/readme.md)...", []string{}},
+		{"...](https://example.com/readme.md#top)...", []string{}},
+		{"...](//example.com/readme.md)...", []string{}},
+		{"[x](ftp://host/x.md) and [y](y.md)", []string{"y.md"}},
 	}
 
 	for _, d := range data {
-		actual := markdownLink(d.line)
-		if actual != d.link {
-			t.Errorf("For line %q expected link %q but got %q",
-				d.line, d.link, actual)
+		actual := markdownLinks(d.line)
+		if !reflect.DeepEqual(actual, d.links) {
+			t.Errorf("For line %q expected links %q but got %q",
+				d.line, d.links, actual)
 		}
 	}
 }
+
+func TestFirstPassForAll_NestedBooks(t *testing.T) {
+	data := map[string]string{
+		"book.md": "# Book\n" +
+			"* [Part one](p1/part.md)\n" +
+			"* [Part two](p2.md)\n",
+		"p1/part.md": "@book\n" +
+			"# Part one\n" +
+			"* [Chapter](chap.md)\n",
+		"p1/chap.md": "## Chapter\n" +
+			"* [Not followed](../p2.md)\n",
+		"p2.md": "# Part two\n",
+	}
+
+	s := newState()
+	s.setFirstInName("book.md")
+	s.book = "book.md"
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		return stringReadCloser{strings.NewReader(data[fName])}, nil
+	}
+	d := newDoc()
+	d.docOutDir = "out"
+
+	if err := firstPassForAll(&s, &d); err != nil {
+		t.Fatalf("Error on first pass for all: %s", err.Error())
+	}
+
+	expInNames := []string{"book.md", "p1/part.md", "p1/chap.md", "p2.md"}
+	if !reflect.DeepEqual(s.inNames, expInNames) {
+		t.Errorf("Expected input files %q but got %q", expInNames, s.inNames)
+	}
+	if d.outNames["p1/chap.md"] != "out/p1/chap.html" {
+		t.Errorf("Expected out name %q but got %q",
+			"out/p1/chap.html", d.outNames["p1/chap.md"])
+	}
+
+	// Sections continue through the files, which each start at line 1
+	expSecs := map[string]string{
+		"book.md":    "1 Book",
+		"p1/part.md": "2 Part one",
+		"p1/chap.md": "2.1 Chapter",
+		"p2.md":      "3 Part two",
+	}
+	for inName, exp := range expSecs {
+		sec, ok := d.secStarts[inName][1]
+		if inName == "p1/part.md" {
+			sec, ok = d.secStarts[inName][2]
+		}
+		if !ok || sec.toString() != exp {
+			t.Errorf("In %s expected section %q but got %#v",
+				inName, exp, d.secStarts[inName])
+		}
+	}
+}
+
+func TestFirstPassForAll_ChapterBookWithBookFlag(t *testing.T) {
+	data := map[string]string{
+		"top.md":  "# Top\n* [Part](part.md)\n",
+		"part.md": "@book\n# Part\n* [Chapter](ch.md)\n",
+		"ch.md":   "## Chapter\n",
+	}
+
+	for _, book := range []bool{true, false} {
+		// As if --book=true or --book=false is on the command line
+		s := newState()
+		s.setFirstInName("top.md")
+		if book {
+			s.book = "top.md"
+		}
+		s.fixed["book"] = true
+		s.reader = func(fName string) (io.ReadCloser, error) {
+			return stringReadCloser{strings.NewReader(data[fName])}, nil
+		}
+		d := newDoc()
+
+		if err := firstPassForAll(&s, &d); err != nil {
+			t.Fatalf("Error on first pass for all: %s", err.Error())
+		}
+
+		exp := []string{"top.md"}
+		if book {
+			exp = []string{"top.md", "part.md", "ch.md"}
+		}
+		if !reflect.DeepEqual(s.inNames, exp) {
+			t.Errorf("Book %v: Expected input files %q but got %q", book, exp, s.inNames)
+		}
+	}
+
+	// The top file can't override the command line
+	s := newState()
+	s.setFirstInName("part.md")
+	s.fixed["book"] = true
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		return stringReadCloser{strings.NewReader(data[fName])}, nil
+	}
+	d := newDoc()
+	if err := firstPassForAll(&s, &d); err != nil {
+		t.Fatalf("Error on first pass for all: %s", err.Error())
+	}
+	if !reflect.DeepEqual(s.inNames, []string{"part.md"}) {
+		t.Errorf("Expected just part.md but got %q", s.inNames)
+	}
+}
+
+func TestFirstPassForAll_BookDepth(t *testing.T) {
+	data := map[string]string{
+		"book.md":  "* [Part](part.md)\n",
+		"part.md":  "* [Chapter](chap.md)\n",
+		"chap.md":  "* [Section](sec.md)\n",
+		"sec.md":   "Not read\n",
+		"other.md": "Not read\n",
+	}
+
+	s := newState()
+	s.setFirstInName("book.md")
+	s.book = "book.md"
+	s.bookDepth = 2
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		return stringReadCloser{strings.NewReader(data[fName])}, nil
+	}
+	d := newDoc()
+
+	firstPassForAll(&s, &d)
+
+	expInNames := []string{"book.md", "part.md", "chap.md"}
+	if !reflect.DeepEqual(s.inNames, expInNames) {
+		t.Errorf("Expected input files %q but got %q", expInNames, s.inNames)
+	}
+}
+
+func TestFirstPassForAll_BookCycles(t *testing.T) {
+	data := map[string]string{
+		"book.md": "* [Part](part.md)\n",
+		"part.md": "@book\n" +
+			"* [Back to the book](book.md)\n" +
+			"* [Itself](part.md)\n",
+	}
+
+	s := newState()
+	s.setFirstInName("book.md")
+	s.book = "book.md"
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		return stringReadCloser{strings.NewReader(data[fName])}, nil
+	}
+	d := newDoc()
+
+	firstPassForAll(&s, &d)
+
+	expInNames := []string{"book.md", "part.md"}
+	if !reflect.DeepEqual(s.inNames, expInNames) {
+		t.Errorf("Expected input files %q but got %q", expInNames, s.inNames)
+	}
+	if len(s.warnings) != 2 {
+		t.Fatalf("Expected 2 warnings but got %#v", s.warnings)
+	}
+	for i, line := range []int{2, 3} {
+		w := s.warnings[i]
+		if w.fName != "part.md" || w.line != line || !strings.Contains(w.msg, "cycle") {
+			t.Errorf("Expected warning about a cycle at part.md line %d but got %#v",
+				line, w)
+		}
+	}
+}
+
+func TestFirstPassForAll_ReadsChaptersOnce(t *testing.T) {
+	data := map[string]string{
+		"book.md": "* [One](one.md) and [two](two.md)\n" +
+			"* [See the README](http://example.com/README.md)\n" +
+			"* [One again](one.md)\n",
+		"one.md": "# One\n",
+		"two.md": "# Two\n",
+	}
+
+	s := newState()
+	s.setFirstInName("book.md")
+	s.book = "book.md"
+	read := make(map[string]int)
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		read[fName]++
+		return stringReadCloser{strings.NewReader(data[fName])}, nil
+	}
+	d := newDoc()
+
+	if err := firstPassForAll(&s, &d); err != nil {
+		t.Fatalf("Error on first pass for all: %s", err.Error())
+	}
+
+	expInNames := []string{"book.md", "one.md", "two.md"}
+	if !reflect.DeepEqual(s.inNames, expInNames) {
+		t.Errorf("Expected input files %q but got %q", expInNames, s.inNames)
+	}
+	for _, inName := range expInNames {
+		if read[inName] != 1 {
+			t.Errorf("Expected to read %s once but read it %d times",
+				inName, read[inName])
+		}
+	}
+	if len(s.warnings) != 0 {
+		t.Errorf("Expected no warnings but got %#v", s.warnings)
+	}
+}
+
+func TestFirstPassForAll_MissingChapter(t *testing.T) {
+	data := map[string]string{
+		"book.md": "# Book\n" +
+			"* [One](one.md)\n" +
+			"* [Missing](missing.md)\n" +
+			"* [Two](two.md)\n",
+		"one.md": "# One\n",
+		"two.md": "# Two\n",
+	}
+
+	s := newState()
+	s.setFirstInName("book.md")
+	s.book = "book.md"
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		content, ok := data[fName]
+		if !ok {
+			return nil, fmt.Errorf("No such file")
+		}
+		return stringReadCloser{strings.NewReader(content)}, nil
+	}
+	d := newDoc()
+
+	if err := firstPassForAll(&s, &d); err != nil {
+		t.Fatalf("Error on first pass for all: %s", err.Error())
+	}
+
+	expInNames := []string{"book.md", "one.md", "two.md"}
+	if !reflect.DeepEqual(s.inNames, expInNames) {
+		t.Errorf("Expected input files %q but got %q", expInNames, s.inNames)
+	}
+	if _, ok := d.outNames["missing.md"]; ok {
+		t.Errorf("Expected no output name for missing.md but got %q",
+			d.outNames["missing.md"])
+	}
+	if sec := d.secStarts["two.md"][1]; sec.toString() != "3 Two" {
+		t.Errorf("Expected two.md to start with section 3 but got %q",
+			sec.toString())
+	}
+
+	if len(s.warnings) != 1 {
+		t.Fatalf("Expected 1 warning but got %#v", s.warnings)
+	}
+	w := s.warnings[0]
+	if w.fName != "book.md" || w.line != 3 || !strings.Contains(w.msg, "missing.md") {
+		t.Errorf("Expected warning about missing.md at book.md line 3 but got %#v", w)
+	}
+}
+
+func TestFirstPassForAll_MissingTopFile(t *testing.T) {
+	s := newState()
+	s.setFirstInName("book.md")
+	s.book = "book.md"
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("No such file")
+	}
+	d := newDoc()
+
+	if err := firstPassForAll(&s, &d); err == nil {
+		t.Errorf("Expected an error for a missing top level file but got none")
+	}
+}
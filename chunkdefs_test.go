@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func chunkDefsTestDoc(t *testing.T, singlePage bool) doc {
+	data := map[string]string{
+		"book.md": "# Reading\n" + // 1
+			"* [Writing](write.md)\n" + // 2
+			"``` main.go\n" + // 3
+			"@{Read}\n" + // 4
+			"```\n" + // 5
+			"``` Read\n" + // 6
+			"open()\n" + // 7
+			"```\n" + // 8
+			"## Closing {-}\n" + // 9
+			"``` Read\n" + // 10
+			"close()\n" + // 11
+			"```\n", // 12
+		"write.md": "# Writing\n" + // 1
+			"``` Read\n" + // 2
+			"check()\n" + // 3
+			"```\n" + // 4
+			"``` Read\n" + // 5
+			"again()\n" + // 6
+			"```\n", // 7
+	}
+
+	s := newState()
+	s.setFirstInName("book.md")
+	s.book = "book.md"
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		return stringReadCloser{strings.NewReader(data[fName])}, nil
+	}
+	d := newDoc()
+	d.singlePage = singlePage
+
+	if err := firstPassForAll(&s, &d); err != nil {
+		t.Fatalf("Error on first pass for all: %s", err.Error())
+	}
+	d.lat = compileLattice(d.chunks)
+	return d
+}
+
+func TestFinalMarkdown_ChunkContinuations(t *testing.T) {
+	d := chunkDefsTestDoc(t, false)
+
+	expected := map[string][]string{
+		"book.md": []string{
+			"<a name=\"main-go\"></a>main.go\n",
+			"<a name=\"Read\"></a>Read <span class=\"chunk-cont\">" +
+				"continued in <a href=\"#Read_2\">Closing</a></span>\n",
+			"<a name=\"Read_2\"></a>Read <span class=\"chunk-cont\">" +
+				"continued from <a href=\"#Read\">§1</a> / " +
+				"continued in <a href=\"write.html#Read_3\">§2</a></span>\n",
+		},
+		"write.md": []string{
+			"<a name=\"Read_3\"></a>Read <span class=\"chunk-cont\">" +
+				"continued from <a href=\"book.html#Read_2\">Closing</a> / " +
+				"continued in <a href=\"#Read_4\">§2</a></span>\n",
+			"<a name=\"Read_4\"></a>Read <span class=\"chunk-cont\">" +
+				"continued from <a href=\"#Read_3\">§2</a></span>\n",
+		},
+	}
+	for inName, subs := range expected {
+		mdown := finalMarkdown(inName, &d).String()
+		for _, sub := range subs {
+			if !strings.Contains(mdown, sub) {
+				t.Errorf("Expected markdown for %s to contain %q but got\n%s",
+					inName, sub, mdown)
+			}
+		}
+	}
+
+	// All in one page, all links are within it
+	d = chunkDefsTestDoc(t, true)
+	mdown := finalMarkdown("write.md", &d).String()
+	sub := "continued from <a href=\"#Read_2\">Closing</a>"
+	if !strings.Contains(mdown, sub) {
+		t.Errorf("Expected markdown to contain %q but got\n%s", sub, mdown)
+	}
+}
+
+func TestHTMLLink_DefinedInTitle(t *testing.T) {
+	d := chunkDefsTestDoc(t, false)
+
+	link := htmlLink("Read", &d, "write.md", "@{Read}")
+	expected := `<a href="book.html#section-1" ` +
+		`title="Defined in §1, Closing and §2">@{Read}</a>`
+	if link != expected {
+		t.Errorf("Expected link %q but got %q", expected, link)
+	}
+
+	// A chunk defined just once needs no title
+	link = htmlLink("main.go", &d, "book.md", "@{main.go}")
+	if link != `<a href="#section-1">@{main.go}</a>` {
+		t.Errorf("Expected a link with no title but got %q", link)
+	}
+}
+
+func TestDefIndex(t *testing.T) {
+	d := chunkDefsTestDoc(t, false)
+
+	data := []struct {
+		name    string
+		inName  string
+		lineNum int
+		exp     int
+	}{
+		{"Read", "book.md", 6, 0},
+		{"Read", "book.md", 10, 1},
+		{"Read", "write.md", 5, 3},
+		{"Read", "write.md", 6, -1},
+		{"main.go", "book.md", 3, 0},
+		{"Missing", "book.md", 3, -1},
+	}
+
+	for _, dt := range data {
+		act := d.defIndex(dt.name, dt.inName, dt.lineNum)
+		if act != dt.exp {
+			t.Errorf("Chunk %q at %s line %d: Expected %d but got %d",
+				dt.name, dt.inName, dt.lineNum, dt.exp, act)
+		}
+	}
+}
+
+func TestFinalMarkdown_ContinuationAnchorsAreUnique(t *testing.T) {
+	data := []string{
+		"# Imports",
+		"``` Imports",
+		"fmt",
+		"```",
+		"``` Imports 2",
+		"os",
+		"```",
+		"``` Imports",
+		"io",
+		"```",
+	}
+
+	for _, anchors := range []string{"numbers", "text"} {
+		s := newState()
+		s.setFirstInName("prog.md")
+		s.reader = func(fName string) (io.ReadCloser, error) {
+			return stringReadCloser{strings.NewReader(strings.Join(data, "\n"))}, nil
+		}
+		d := newDoc()
+		d.anchors = anchors
+		if err := firstPassForAll(&s, &d); err != nil {
+			t.Fatalf("Error on first pass for all: %s", err.Error())
+		}
+		d.lat = compileLattice(d.chunks)
+
+		mdown := finalMarkdown("prog.md", &d).String()
+		seen := make(set)
+		for _, name := range regexp.MustCompile(`<a (?:name|id)="([^"]*)">`).
+			FindAllStringSubmatch(mdown, -1) {
+			if seen[name[1]] {
+				t.Errorf("Anchors %s: Expected anchor %q only once but got\n%s",
+					anchors, name[1], mdown)
+			}
+			seen[name[1]] = true
+		}
+		link := "continued in <a href=\"#" + d.defAnchor("Imports", 1) + "\">"
+		target := d.chunkAnchors("Imports", 1) + "Imports <span"
+		if !strings.Contains(mdown, link) || !strings.Contains(mdown, target) {
+			t.Errorf("Anchors %s: Expected %q to go to %q but got\n%s",
+				anchors, link, target, mdown)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func chunkIndexTestDoc(t *testing.T) builderDoc {
+	data := map[string]string{
+		"book.md": "# Book\n" + // 1
+			"@chunk-index\n" + // 2
+			"* [Chapter](ch/one.md)\n" + // 3
+			"``` main.go\n" + // 4
+			"@{Imports}\n" + // 5
+			"@{functions}\n" + // 6
+			"```\n" + // 7
+			"## Imports\n" + // 8
+			"``` Imports\n" + // 9
+			"import \"fmt\"\n" + // 10
+			"```\n", // 11
+		"ch/one.md": "# Chapter\n" + // 1
+			"``` functions\n" + // 2
+			"func one() {}\n" + // 3
+			"```\n" + // 4
+			"## More\n" + // 5
+			"``` functions\n" + // 6
+			"func two() {}\n" + // 7
+			"```\n" + // 8
+			"``` functions\n" + // 9
+			"func three() {}\n" + // 10
+			"```\n" + // 11
+			"``` other.go\n" + // 12
+			"@{Imports}\n" + // 13
+			"```\n", // 14
+	}
+
+	s := newState()
+	s.setFirstInName("book.md")
+	s.book = "book.md"
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		return stringReadCloser{strings.NewReader(data[fName])}, nil
+	}
+	d := newBuilderDoc(newDoc())
+	d.docOutDir = "out"
+	d.codeOutDir = "src"
+
+	if err := firstPassForAll(&s, &d.doc); err != nil {
+		t.Fatalf("Error on first pass for all: %s", err.Error())
+	}
+	d.lat = compileLattice(d.chunks)
+	return d
+}
+
+func TestChunkIndex(t *testing.T) {
+	d := chunkIndexTestDoc(t)
+
+	expected := "* `functions`: defined in sections [2](ch/one.html#section-2) " +
+		"and [2.1](ch/one.html#section-2.1); " +
+		"used in section [1](book.html#section-1). " +
+		"Ends up in `src/main.go`.\n" +
+		"* `Imports`: defined in section [1.1](book.html#section-1.1); " +
+		"used in sections [1](book.html#section-1) " +
+		"and [2.1](ch/one.html#section-2.1). " +
+		"Ends up in `src/main.go` and `src/other.go`.\n" +
+		"* `main.go` (top level): defined in section [1](book.html#section-1). " +
+		"Ends up in `src/main.go`.\n" +
+		"* `other.go` (top level): defined in section [2.1](ch/one.html#section-2.1). " +
+		"Ends up in `src/other.go`.\n"
+
+	act := d.chunkIndex("out/book.html")
+	if act != expected {
+		t.Errorf("Expected index\n%s\nbut got\n%s", expected, act)
+	}
+
+	// Links are relative to the output file they're in
+	act = d.chunkIndex("out/ch/one.html")
+	for _, sub := range []string{
+		"[1](../book.html#section-1)",
+		"[2.1](one.html#section-2.1)",
+	} {
+		if !strings.Contains(act, sub) {
+			t.Errorf("Expected index to contain %q but got\n%s", sub, act)
+		}
+	}
+}
+
+func TestFinalMarkdown_ChunkIndexDirective(t *testing.T) {
+	d := chunkIndexTestDoc(t)
+
+	mdown := finalMarkdown("book.md", &d.doc).String()
+
+	expStart := "# <a name=\"section-1\"></a>1 Book\n" +
+		"\n" +
+		"* `functions`: defined in sections"
+	if !strings.HasPrefix(mdown, expStart) {
+		t.Errorf("Expected markdown to start\n%s\nbut got\n%s", expStart, mdown)
+	}
+	if strings.Contains(mdown, "@chunk-index") {
+		t.Errorf("Expected directive to be removed but got\n%s", mdown)
+	}
+}
+
+func TestWriteChunkIndex(t *testing.T) {
+	d := chunkIndexTestDoc(t)
+
+	if err := writeChunkIndex(&d.doc); err != nil {
+		t.Fatalf("Error writing chunk index: %s", err.Error())
+	}
+
+	out, ok := d.outputs["out/chunk-index.html"]
+	if !ok {
+		t.Fatalf("Expected chunk-index.html to be written, but got %#v", d.outputs)
+	}
+	for _, sub := range []string{
+		"<title>Chunk index</title>",
+		`<code>other.go</code> (top level)`,
+		`<a href="ch/one.html#section-2.1">2.1</a>`,
+	} {
+		if !strings.Contains(out.String(), sub) {
+			t.Errorf("Expected chunk index page to contain %q but got\n%s",
+				sub, out.String())
+		}
+	}
+
+	// Not for a single file
+	d = newBuilderDoc(newDoc())
+	d.inNames = []string{"book.md"}
+	d.outNames["book.md"] = "book.html"
+
+	if err := writeChunkIndex(&d.doc); err != nil {
+		t.Fatalf("Error writing chunk index: %s", err.Error())
+	}
+	if len(d.outputs) != 0 {
+		t.Errorf("Expected no chunk index page for one file but got %#v", d.outputs)
+	}
+
+	// Not if there are no chunks
+	d = newBuilderDoc(newDoc())
+	d.inNames = []string{"book.md", "ch.md"}
+	d.outNames["book.md"] = "book.html"
+	d.outNames["ch.md"] = "ch.html"
+
+	if err := writeChunkIndex(&d.doc); err != nil {
+		t.Fatalf("Error writing chunk index: %s", err.Error())
+	}
+	if len(d.outputs) != 0 {
+		t.Errorf("Expected no chunk index page with no chunks but got %#v", d.outputs)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func contentsTestDoc(t *testing.T) (state, builderDoc) {
+	data := map[string]string{
+		"book.md": "Introduction\n" +
+			"@contents\n" +
+			"# Book\n" +
+			"* [Chapter one](ch/one.md)\n" +
+			"* [Chapter two](two.md)\n",
+		"ch/one.md": "More of the book\n" +
+			"## One\n" +
+			"#### Deep\n" +
+			"``` Chunk\n" +
+			"# Not a heading\n" +
+			"```\n" +
+			"### Three\n",
+		"two.md": "# Two\n" +
+			"## Two point one\n",
+	}
+
+	s := newState()
+	s.setFirstInName("book.md")
+	s.book = "book.md"
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		return stringReadCloser{strings.NewReader(data[fName])}, nil
+	}
+	d := newBuilderDoc(newDoc())
+	d.docOutDir = "out"
+
+	if err := firstPassForAll(&s, &d.doc); err != nil {
+		t.Fatalf("Error on first pass for all: %s", err.Error())
+	}
+	d.lat = compileLattice(d.chunks)
+	return s, d
+}
+
+func TestTableOfContents(t *testing.T) {
+	_, d := contentsTestDoc(t)
+
+	expected := "* [1 Book](book.html#section-1)\n" +
+		"    * [1.1 One](ch/one.html#section-1.1)\n" +
+		"        * [1.1.1.1 Deep](ch/one.html#section-1.1.1.1)\n" +
+		"        * [1.1.2 Three](ch/one.html#section-1.1.2)\n" +
+		"* [2 Two](two.html#section-2)\n" +
+		"    * [2.1 Two point one](two.html#section-2.1)\n"
+
+	act := d.tableOfContents("out/book.html")
+	if act != expected {
+		t.Errorf("Expected contents\n%s\nbut got\n%s", expected, act)
+	}
+
+	// Links are relative to the output file they're in
+	act = d.tableOfContents("out/ch/one.html")
+	for _, sub := range []string{
+		"(../book.html#section-1)",
+		"(one.html#section-1.1)",
+		"(../two.html#section-2)",
+	} {
+		if !strings.Contains(act, sub) {
+			t.Errorf("Expected contents to contain %q but got\n%s", sub, act)
+		}
+	}
+}
+
+func TestFinalMarkdown_ContentsDirective(t *testing.T) {
+	_, d := contentsTestDoc(t)
+
+	mdown := finalMarkdown("book.md", &d.doc).String()
+
+	expStart := "<a name=\"section-0\"></a>\n" +
+		"Introduction\n" +
+		"\n" +
+		"* [1 Book](book.html#section-1)\n"
+	if !strings.HasPrefix(mdown, expStart) {
+		t.Errorf("Expected markdown to start\n%s\nbut got\n%s", expStart, mdown)
+	}
+	if !strings.Contains(mdown, "    * [2.1 Two point one](two.html#section-2.1)\n") {
+		t.Errorf("Expected contents to include section 2.1 but got\n%s", mdown)
+	}
+	if strings.Contains(mdown, "@contents") {
+		t.Errorf("Expected directive to be removed but got\n%s", mdown)
+	}
+}
+
+func TestWriteContents(t *testing.T) {
+	_, d := contentsTestDoc(t)
+
+	if err := writeContents(&d.doc); err != nil {
+		t.Fatalf("Error writing contents: %s", err.Error())
+	}
+
+	out, ok := d.outputs["out/contents.html"]
+	if !ok {
+		t.Fatalf("Expected contents.html to be written, but got %#v", d.outputs)
+	}
+	for _, sub := range []string{
+		"<title>Contents</title>",
+		`<a href="ch/one.html#section-1.1">1.1 One</a>`,
+	} {
+		if !strings.Contains(out.String(), sub) {
+			t.Errorf("Expected contents page to contain %q but got\n%s",
+				sub, out.String())
+		}
+	}
+}
+
+func TestWriteContents_NotWritten(t *testing.T) {
+	// Not for a single file
+	d := newBuilderDoc(newDoc())
+	d.inNames = []string{"book.md"}
+	d.outNames["book.md"] = "book.html"
+
+	if err := writeContents(&d.doc); err != nil {
+		t.Fatalf("Error writing contents: %s", err.Error())
+	}
+	if len(d.outputs) != 0 {
+		t.Errorf("Expected no contents page for one file but got %#v", d.outputs)
+	}
+
+	// Not if it would overwrite a chapter
+	d = newBuilderDoc(newDoc())
+	d.inNames = []string{"book.md", "contents.md"}
+	d.outNames["book.md"] = "book.html"
+	d.outNames["contents.md"] = "contents.html"
+
+	if err := writeContents(&d.doc); err != nil {
+		t.Fatalf("Error writing contents: %s", err.Error())
+	}
+	if len(d.outputs) != 0 {
+		t.Errorf("Expected no contents page to overwrite a chapter but got %#v",
+			d.outputs)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTranslatorFor(t *testing.T) {
+	s := newState()
+
+	s.setFirstInName("book.lit")
+	if got := s.translate(&s, "@s Section"); got != "# Section" {
+		t.Errorf("Expected .lit file to be read as Literate, but got %q", got)
+	}
+
+	s.setInName("chapter.md")
+	if got := s.translate(&s, "@s Section"); got != "@s Section" {
+		t.Errorf("Expected .md file to be read as markdown, but got %q", got)
+	}
+
+	s.setInName("chapter.nw")
+	if got := s.translate(&s, "<<Chunk>>="); got != "``` Chunk" {
+		t.Errorf("Expected .nw file to be read as noweb, but got %q", got)
+	}
+
+	s.dialect = "noweb"
+	s.setInName("chapter.md")
+	if got := s.translate(&s, "<<Chunk>>="); got != "``` Chunk" {
+		t.Errorf("Expected dialect to override extension, but got %q", got)
+	}
+}
+
+func TestFromLiterate(t *testing.T) {
+	data := []struct {
+		inChunk bool
+		line    string
+		exp     string
+	}{
+		{false, "Some prose", "Some prose"},
+		{false, "@s", "# "},
+		{false, "@s A section", "# A section"},
+		{false, "@sa", "@sa"},
+		{false, "@title The title", "@title The title"},
+		{false, "@code_type Go .go", "@ignore"},
+		{false, "@comment_type // %s", "@comment-style // %s"},
+		{false, "--- main.go", "``` main.go"},
+		{false, "---Functions", "``` Functions"},
+		{false, "--- Functions +=", "``` Functions"},
+		{false, "---", "---"},
+		{false, "``` Markdown chunk", "``` Markdown chunk"},
+		{true, "    @{Functions}", "    @{Functions}"},
+		{true, "--- Not a new chunk", "--- Not a new chunk"},
+		{true, "@s Not a section", "@s Not a section"},
+		{true, "---", "```"},
+	}
+
+	for _, d := range data {
+		s := newState()
+		s.setFirstInName("test.lit")
+		s.inChunk = d.inChunk
+		act := fromLiterate(&s, d.line)
+		if act != d.exp {
+			t.Errorf("In chunk %t, line %q: Expected %q but got %q",
+				d.inChunk, d.line, d.exp, act)
+		}
+	}
+}
+
+func TestProcessContent_Literate(t *testing.T) {
+	s := newState()
+	s.setFirstInName("prog.lit")
+	d := newDoc()
+	lines := []string{
+		"@title A program",
+		"@code_type Go .go",
+		"@comment_type // %s",
+		"",
+		"@s Structure",
+		"",
+		"--- prog.go",
+		"package main",
+		"@{Functions}",
+		"---",
+		"",
+		"@s Functions",
+		"",
+		"--- Functions",
+		"func one() {}",
+		"---",
+		"",
+		"--- Functions :=",
+		"func two() {}",
+		"---",
+	}
+	r := strings.NewReader(strings.Join(lines, "\n"))
+
+	processContent(r, &s, &d)
+
+	if d.title != "A program" {
+		t.Errorf("Expected title %q but got %q", "A program", d.title)
+	}
+	if d.commentStyle != "// %s" {
+		t.Errorf("Expected comment style %q but got %q", "// %s", d.commentStyle)
+	}
+	if len(d.chunks) != 2 {
+		t.Errorf("Expected 2 chunks but got %d: %#v", len(d.chunks), d.chunks)
+	}
+	if ch := d.chunks["Functions"]; ch == nil || len(ch.def) != 2 ||
+		ch.def[0].sec.toString() != "2 Functions" {
+		t.Errorf("Expected Functions defined twice in section 2, but got %#v", ch)
+	}
+	if d.chunkStarts[s.inName][7] != "prog.go" {
+		t.Errorf("Expected chunk prog.go to start at line 7, but got %#v",
+			d.chunkStarts[s.inName])
+	}
+	if _, ok := d.chunkRefs[s.inName][10]; !ok {
+		t.Errorf("Expected a chunk to end at line 10, but got %#v",
+			d.chunkRefs[s.inName])
+	}
+	if len(s.warnings) != 1 || s.warnings[0].line != 18 {
+		t.Errorf("Expected one warning about := at line 18, but got %#v",
+			s.warnings)
+	}
+	if s.inChunk {
+		t.Errorf("Content ended but still in chunk")
+	}
+}
+
+func TestFromNoweb(t *testing.T) {
+	data := []struct {
+		inChunk bool
+		line    string
+		exp     string
+	}{
+		{false, "Some prose", "Some prose"},
+		{false, "<<Read the file>>=", "``` Read the file"},
+		{false, "<< Read the file >>=  ", "``` Read the file"},
+		{false, "<<Read the file>>", "<<Read the file>>"},
+		{false, "@", "@"},
+		{true, "f, err := os.Open(name)", "f, err := os.Open(name)"},
+		{true, "<<Read the file>>", "@{Read the file}"},
+		{true, "    <<Read the file>>", "    @{Read the file}"},
+		{true, "x := a @<<b>> c", "x := a <<b>> c"},
+		{true, "@", "```"},
+		{true, "@ %def readFile", "```"},
+		{true, "@ Some prose", "```\nSome prose"},
+		{true, "<<Write the file>>=", "```\n``` Write the file"},
+		{true, "@{Not noweb}", "@{Not noweb}"},
+	}
+
+	for _, d := range data {
+		s := newState()
+		s.setFirstInName("test.nw")
+		s.inChunk = d.inChunk
+		act := fromNoweb(&s, d.line)
+		if act != d.exp {
+			t.Errorf("In chunk %t, line %q: Expected %q but got %q",
+				d.inChunk, d.line, d.exp, act)
+		}
+	}
+}
+
+func TestProcessContent_Noweb(t *testing.T) {
+	s := newState()
+	s.dialect = "noweb"
+	s.setFirstInName("prog.md")
+	d := newDoc()
+	lines := []string{
+		"# Structure",
+		"<<prog.go>>=",
+		"package main",
+		"<<Functions>>",
+		"@",
+		"# Functions",
+		"<<Functions>>=",
+		"func one() {}",
+		"<<More>>=",
+		"func two() {}",
+		"@ Some prose",
+	}
+	r := strings.NewReader(strings.Join(lines, "\n"))
+
+	processContent(r, &s, &d)
+	d.lat = compileLattice(d.chunks)
+
+	if len(d.chunks) != 3 {
+		t.Errorf("Expected 3 chunks but got %d: %#v", len(d.chunks), d.chunks)
+	}
+	if !d.lat.childrenOf["prog.go"]["Functions"] {
+		t.Errorf("Expected prog.go to include Functions, but lattice is %#v", d.lat)
+	}
+	if _, ok := d.chunkRefs[s.inName][5]; !ok {
+		t.Errorf("Expected a chunk to end at line 5, but got %#v",
+			d.chunkRefs[s.inName])
+	}
+	if ch := d.chunks["Functions"]; ch == nil || ch.def[0].sec.toString() != "2 Functions" {
+		t.Errorf("Expected Functions defined in section 2, but got %#v", ch)
+	}
+	if s.inChunk {
+		t.Errorf("Content ended but still in chunk")
+	}
+
+	// A chunk ends when another starts
+	if code := d.chunks["Functions"].cont; len(code) != 1 || code[0].code != "func one() {}" {
+		t.Errorf("Expected Functions to end before More, but got %#v", code)
+	}
+	if ref := d.chunkRefs[s.inName][9]; ref.name != "Functions" {
+		t.Errorf("Expected Functions to end at line 9, but got %#v", ref)
+	}
+	if d.chunkStarts[s.inName][9] != "More" {
+		t.Errorf("Expected More to start at line 9, but got %#v", d.chunkStarts[s.inName])
+	}
+	code := d.chunks["More"].cont
+	if len(code) != 1 || code[0].code != "func two() {}" || code[0].lNum != 10 {
+		t.Errorf("Expected More to be func two() at line 10, but got %#v", code)
+	}
+	if len(s.warnings) != 0 {
+		t.Errorf("Expected no warnings, but got %#v", s.warnings)
+	}
+
+	// Each part is written out in order, with the prose kept
+	mdown := finalMarkdown(s.inName, &d).String()
+	for _, sub := range []string{
+		"```go\nfunc one() {}\n```\n{.chunk-refs}\nUsed in section",
+		"<a name=\"More\"></a>More\n\n```More\nfunc two() {}\n```\nSome prose\n",
+	} {
+		if !strings.Contains(mdown, sub) {
+			t.Errorf("Expected markdown to contain %q but got\n%s", sub, mdown)
+		}
+	}
+}
+
+func TestFromOrg(t *testing.T) {
+	data := []struct {
+		inChunk bool
+		inFence bool
+		line    string
+		exp     string
+	}{
+		{false, false, "Some prose", "Some prose"},
+		{false, false, "* A heading", "# A heading"},
+		{false, false, "*** A sub heading   :tag1:tag2:", "### A sub heading"},
+		{false, false, "*Bold* text", "*Bold* text"},
+		{false, false, "#+TITLE: The title", "@title The title"},
+		{false, false, "#+author: Someone", ""},
+		{false, false, "# A comment", ""},
+		{false, false, "#+begin_src go :tangle main.go", "``` main.go"},
+		{false, false, "#+BEGIN_SRC go :noweb-ref Read the file", "``` Read the file"},
+		{false, false, `#+begin_src go :noweb-ref "Read the file" :exports code`,
+			"``` Read the file"},
+		{false, false, "#+begin_src go :tangle no :noweb-ref Func", "``` Func"},
+		{false, false, "#+begin_src sh", "~~~sh"},
+		{false, false, "#+begin_example", "~~~"},
+		{false, false, "See [[file:other.org][the other file]].",
+			"See [the other file](other.org)."},
+		{false, false, "See [[https://orgmode.org]]",
+			"See [https://orgmode.org](https://orgmode.org)"},
+		{false, false, "Use =go build= or ~make~.", "Use `go build` or `make`."},
+		{false, false, "Paths like /usr/bin=x stay", "Paths like /usr/bin=x stay"},
+		{true, false, "  <<Read the file>>", "  @{Read the file}"},
+		{true, false, "* not a heading", "* not a heading"},
+		{true, false, "  ,* escaped", "  * escaped"},
+		{true, false, ",#+begin_src", "#+begin_src"},
+		{true, false, "#+end_src", "```"},
+		{false, true, "* not a heading", "* not a heading"},
+		{false, true, "<<Not a reference>>", "<<Not a reference>>"},
+		{false, true, "#+END_SRC", "~~~"},
+		{false, true, "#+end_example", "~~~"},
+	}
+
+	for _, d := range data {
+		s := newState()
+		s.setFirstInName("test.org")
+		s.inChunk = d.inChunk
+		s.inFence = d.inFence
+		act := fromOrg(&s, d.line)
+		if act != d.exp {
+			t.Errorf("In chunk %t, fence %t, line %q: Expected %q but got %q",
+				d.inChunk, d.inFence, d.line, d.exp, act)
+		}
+	}
+}
+
+func TestProcessContent_Org(t *testing.T) {
+	s := newState()
+	s.setFirstInName("notes.org")
+	d := newDoc()
+	lines := []string{
+		"#+title: Design notes",
+		"* Structure",
+		"#+begin_src go :tangle prog.go",
+		"package main",
+		"<<Functions>>",
+		"#+end_src",
+		"** Functions",
+		"#+begin_src go :noweb-ref Functions",
+		"func one() {}",
+		"#+end_src",
+		"#+begin_src sh",
+		"# Not a heading",
+		"#+end_src",
+		"* Next",
+	}
+	r := strings.NewReader(strings.Join(lines, "\n"))
+
+	processContent(r, &s, &d)
+	d.lat = compileLattice(d.chunks)
+
+	if d.title != "Design notes" {
+		t.Errorf("Expected title %q but got %q", "Design notes", d.title)
+	}
+	if len(d.chunks) != 2 {
+		t.Errorf("Expected 2 chunks but got %d: %#v", len(d.chunks), d.chunks)
+	}
+	if !d.lat.childrenOf["prog.go"]["Functions"] {
+		t.Errorf("Expected prog.go to include Functions, but lattice is %#v", d.lat)
+	}
+	if ch := d.chunks["Functions"]; ch == nil || ch.def[0].sec.toString() != "1.1 Functions" {
+		t.Errorf("Expected Functions defined in section 1.1, but got %#v", ch)
+	}
+	if s.sec.toString() != "2 Next" {
+		t.Errorf("Expected to end in section 2, but got %q", s.sec.toString())
+	}
+	expMarkdown := "~~~sh\n# Not a heading\n~~~\n"
+	if !strings.Contains(d.markdown[s.inName].String(), expMarkdown) {
+		t.Errorf("Expected markdown to contain %q but got %q",
+			expMarkdown, d.markdown[s.inName].String())
+	}
+	if len(s.warnings) != 0 {
+		t.Errorf("Expected no warnings, but got %#v", s.warnings)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDirective(t *testing.T) {
+	data := []struct {
+		line string
+		name string
+		arg  string
+		ok   bool
+	}{
+		{"@title My book", "title", "My book", true},
+		{"@line-dir  //line %f:%l ", "line-dir", "//line %f:%l", true},
+		{"@ignore", "ignore", "", true},
+		{"@book ", "book", "", true},
+		{"@comment-style // %s", "comment-style", "// %s", true},
+		{"@{Chunk name}", "", "", false},
+		{" @title Indented", "", "", false},
+		{"@Title Upper case", "", "", false},
+		{"Ordinary @title text", "", "", false},
+		{"@", "", "", false},
+	}
+
+	for _, d := range data {
+		name, arg, ok := directive(d.line)
+		if name != d.name || arg != d.arg || ok != d.ok {
+			t.Errorf("Line %q: Expected (%q, %q, %t) but got (%q, %q, %t)",
+				d.line, d.name, d.arg, d.ok, name, arg, ok)
+		}
+	}
+}
+
+func TestProcForDirectives(t *testing.T) {
+	s := newState()
+	s.setFirstInName("directives.md")
+	d := newDoc()
+	lines := []string{
+		"@title The title",
+		"@ignore",
+		"@line-dir //line %l",
+		"# Heading",
+		"@comment-style // %s",
+		"@strict",
+		"``` Chunk",
+		"@title Not a directive in a chunk",
+		"```",
+		"@unknown thing",
+		"## Subheading",
+	}
+
+	for _, line := range lines {
+		s.proc(&s, &d, line)
+	}
+
+	if d.title != "The title" {
+		t.Errorf("Expected title %q but got %q", "The title", d.title)
+	}
+	if d.lineDir != "//line %l" {
+		t.Errorf("Expected line directive %q but got %q", "//line %l", d.lineDir)
+	}
+	if d.commentStyle != "// %s" {
+		t.Errorf("Expected comment style %q but got %q", "// %s", d.commentStyle)
+	}
+	if !d.strict {
+		t.Errorf("Expected strict mode")
+	}
+
+	// Directives are blanked out, but line numbers are preserved
+	expMarkdown := "\n\n\n# Heading\n\n\n``` Chunk\n" +
+		"@title Not a directive in a chunk\n```\n\n## Subheading\n"
+	if d.markdown[s.inName].String() != expMarkdown {
+		t.Errorf("Expected markdown %q but got %q",
+			expMarkdown, d.markdown[s.inName].String())
+	}
+	if sec, ok := d.secStarts[s.inName][4]; !ok || sec.toString() != "1 Heading" {
+		t.Errorf("Expected section 1 to start at line 4, but got %#v",
+			d.secStarts[s.inName])
+	}
+	if sec, ok := d.secStarts[s.inName][11]; !ok || sec.toString() != "1.1 Subheading" {
+		t.Errorf("Expected section 1.1 to start at line 11, but got %#v",
+			d.secStarts[s.inName])
+	}
+	code := d.chunks["Chunk"].cont
+	if len(code) != 1 || code[0].code != "@title Not a directive in a chunk" {
+		t.Errorf("Expected directive-like line in chunk, but got %#v", code)
+	}
+
+	// Only the unknown directive is warned about
+	if len(s.warnings) != 1 {
+		t.Fatalf("Expected 1 warning but got %d: %#v",
+			len(s.warnings), s.warnings)
+	}
+	w := s.warnings[0]
+	if w.fName != "directives.md" || w.line != 10 ||
+		!strings.Contains(w.msg, "@unknown") {
+		t.Errorf("Expected warning about @unknown at line 10, but got %#v", w)
+	}
+}
+
+func TestProcForDirectives_CommandLineTakesPrecedence(t *testing.T) {
+	s := newState()
+	s.setFirstInName("fixed.md")
+	s.fixed = set{"line-dir": true, "code-out-dir": true, "strict": true}
+	d := newDoc()
+	d.lineDir = "#line %l"
+	d.codeOutDir = "cmd"
+
+	s.proc(&s, &d, "@line-dir //line %l")
+	s.proc(&s, &d, "@out-dir out")
+	s.proc(&s, &d, "@strict")
+
+	if d.lineDir != "#line %l" {
+		t.Errorf("Expected line directive %q but got %q", "#line %l", d.lineDir)
+	}
+	if d.codeOutDir != "cmd" {
+		t.Errorf("Expected code out dir %q but got %q", "cmd", d.codeOutDir)
+	}
+	if d.docOutDir != "out" {
+		t.Errorf("Expected doc out dir %q but got %q", "out", d.docOutDir)
+	}
+	if d.strict {
+		t.Errorf("Expected strict mode to be off, as on the command line")
+	}
+}
+
+func TestFirstPassForAll_BookDirective(t *testing.T) {
+	data := map[string]string{
+		"dir/book.md": "@book\n" +
+			"@doc-out-dir out\n" +
+			"* [First chapter](first.md)\n",
+		"dir/first.md": "@book\n" +
+			"* [Second chapter](second.md)\n",
+		"dir/second.md": "Second line 1\n",
+	}
+
+	s := newState()
+	s.setFirstInName("dir/book.md")
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		return stringReadCloser{strings.NewReader(data[fName])}, nil
+	}
+	d := newDoc()
+
+	firstPassForAll(&s, &d)
+
+	if len(s.inNames) != 3 {
+		t.Errorf("Expected to read 3 files, but got %q", s.inNames)
+	}
+	expOutNames := map[string]string{
+		"dir/book.md":   "dir/out/book.html",
+		"dir/first.md":  "dir/out/first.html",
+		"dir/second.md": "dir/out/second.html",
+	}
+	for inName, exp := range expOutNames {
+		if d.outNames[inName] != exp {
+			t.Errorf("Expected out name of %s to be %q but got %q",
+				inName, exp, d.outNames[inName])
+		}
+	}
+	if len(s.warnings) != 0 {
+		t.Errorf("Expected no warnings but got %#v", s.warnings)
+	}
+}
@@ -12,7 +12,8 @@ func TestFinalMarkdown_AmendChapterLinks(t *testing.T) {
              * [Second chapter](sec/second.md)`,
 		"first.md": `* First [line 1](book.md)
             * First [line 2](sec/second.md)
-            * First line 3`,
+            * First line 3
+            * [Book](book.md), [web](http://x.com/a.md) and [second](sec/second.md)`,
 		"sec/second.md": `* Second line 1\
             * Second [line 2](not-a-chapter.md)
             * [First chapter](../first.md)`,
@@ -25,6 +26,7 @@ func TestFinalMarkdown_AmendChapterLinks(t *testing.T) {
 		"first.md": []string{
 			"[line 1](book.html)",
 			"[line 2](sec/second.html)",
+			"[Book](book.html), [web](http://x.com/a.md) and [second](sec/second.html)",
 		},
 		"sec/second.md": []string{
 			"[line 2](not-a-chapter.md)",
@@ -64,7 +66,8 @@ func TestFinalMarkdown_AmendChapterLinksWithAnchors(t *testing.T) {
              * [Second chapter](sec/second.md#summary)`,
 		"first.md": `* First [line 1](book.md#preface)
             * First [line 2](sec/second.md)
-            * First line 3`,
+            * First line 3
+            * [Book](book.md), [web](http://x.com/a.md) and [second](sec/second.md)`,
 		"sec/second.md": `* Second line 1\
             * Second [line 2](not-a-chapter.md)
             * [First chapter](../first.md)`,
@@ -77,6 +80,7 @@ func TestFinalMarkdown_AmendChapterLinksWithAnchors(t *testing.T) {
 		"first.md": []string{
 			"[line 1](book.html#preface)",
 			"[line 2](sec/second.html)",
+			"[Book](book.html), [web](http://x.com/a.md) and [second](sec/second.html)",
 		},
 		"sec/second.md": []string{
 			"[line 2](not-a-chapter.md)",
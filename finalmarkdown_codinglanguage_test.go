@@ -18,7 +18,7 @@ func TestFinalMarkdown_CodingLanguage_TwoLanguages(t *testing.T) {
 		"``` Chunk one", // Line 6
 		"@{Chunk 1a}",
 		"```",
-		// Post-chunk blank
+		// Post-chunk class
 		// Post-chunk ref (added to in...)
 		// Post-chunk blank
 		// Styling before chunk name
@@ -27,7 +27,7 @@ func TestFinalMarkdown_CodingLanguage_TwoLanguages(t *testing.T) {
 		"``` Chunk one", // Line 15
 		"Content 1.2",
 		"```",
-		// Post-chunk blank
+		// Post-chunk class
 		// Post-chunk ref (added to in...)
 		// Post-chunk blank
 		// Styling before chunk name
@@ -36,7 +36,7 @@ func TestFinalMarkdown_CodingLanguage_TwoLanguages(t *testing.T) {
 		"```Chunk 1a", // Line 24
 		"Content 1a.1",
 		"```",
-		// Post-chunk blank
+		// Post-chunk class
 		// Post-chunk ref (used in...)
 		// Post-chunk blank
 		"# Language two",
@@ -53,7 +53,7 @@ func TestFinalMarkdown_CodingLanguage_TwoLanguages(t *testing.T) {
 		"``` Chunk 2a", // Line 41
 		"Content 2a.1",
 		"```",
-		// Post-chunk blank
+		// Post-chunk class
 		// Post-chunk ref (used in...)
 		// Post-chunk blank
 	}
@@ -101,7 +101,7 @@ func TestFinalMarkdown_CodingLanguage_MissingLanguages(t *testing.T) {
 		"```Chunk 1a", // Line 13
 		"Content 1a.1",
 		"```",
-		// Post-chunk blank
+		// Post-chunk class
 		// Post-chunk ref (used in...)
 		// Post-chunk blank
 		"# Language two",
@@ -118,7 +118,7 @@ func TestFinalMarkdown_CodingLanguage_MissingLanguages(t *testing.T) {
 		"``` Chunk 2a", // Line 30
 		"Content 2a.1",
 		"```",
-		// Post-chunk blank
+		// Post-chunk class
 		// Post-chunk ref (used in...)
 		// Post-chunk blank
 	}
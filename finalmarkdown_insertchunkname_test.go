@@ -18,7 +18,7 @@ func TestFinalMarkdown_ChunkStart_ChunkNamesGiven(t *testing.T) {
 		"``` Chunk one",
 		"Content 1.1",
 		"```",
-		// Post-chunk blank
+		// Post-chunk class
 		// Post-chunk ref (added to in...)
 		// Post-chunk blank
 		"",
@@ -35,19 +35,21 @@ func TestFinalMarkdown_ChunkStart_ChunkNamesGiven(t *testing.T) {
 		"``` Chunk one",
 		"Content 1.2",
 		"```",
-		// Post-chunk blank
+		// Post-chunk class
 		// Post-chunk ref (added to in...)
 		// Post-chunk blank
 	}
 	expected := map[int]string{
-		3:  "{.chunk-name}",
-		4:  "<a name=\"Chunk-one\"></a>Chunk one",
+		3: "{.chunk-name}",
+		4: "<a name=\"Chunk-one\"></a>Chunk one <span class=\"chunk-cont\">" +
+			"continued in <a href=\"#Chunk-one_2\">§1</a></span>",
 		5:  "",
 		13: "{.chunk-name}",
 		14: "<a name=\"Chunk-two\"></a>Chunk two",
 		15: "",
 		20: "{.chunk-name}",
-		21: "Chunk one",
+		21: "<a name=\"Chunk-one_2\"></a>Chunk one <span class=\"chunk-cont\">" +
+			"continued from <a href=\"#Chunk-one\">§1</a></span>",
 		22: "",
 	}
 	content := strings.NewReader(strings.Join(lines, "\n"))
@@ -64,3 +66,36 @@ func TestFinalMarkdown_ChunkStart_ChunkNamesGiven(t *testing.T) {
 		}
 	}
 }
+
+func TestFinalMarkdown_ChunkStart_AfterParagraph(t *testing.T) {
+	d := newDoc()
+	s := newState()
+	s.setFirstInName("test.md")
+	lines := []string{
+		"# Section one",
+		"Some text", // Line 2
+		// Blank line inserted  // Line 3
+		// Styling for chunk name  // Line 4
+		"``` Chunk one",
+		"Content 1.1",
+		"```",
+	}
+	expected := map[int]string{
+		2: "Some text",
+		3: "",
+		4: "{.chunk-name}",
+	}
+	content := strings.NewReader(strings.Join(lines, "\n"))
+
+	processContent(content, &s, &d)
+	d.lat = compileLattice(d.chunks)
+	b := finalMarkdown(s.inName, &d)
+	out := strings.Split(b.String(), "\n")
+
+	for n, s := range expected {
+		if out[n-1] != s {
+			t.Errorf("Expected line %d to be %q but got %q",
+				n, s, out[n-1])
+		}
+	}
+}
@@ -70,7 +70,7 @@ func TestFinalMarkdown_ChunkRefs_AddedToOnce(t *testing.T) {
 		"``` Chunk one",
 		"Chunk content",
 		"```",
-		// Post-chunk blank // Line 9
+		// Post-chunk class // Line 9
 		// Post-chunk ref
 		// Post-chunk blank
 		"# T2",
@@ -79,16 +79,16 @@ func TestFinalMarkdown_ChunkRefs_AddedToOnce(t *testing.T) {
 		// Blank line
 		"``` Chunk one",
 		"```",
-		// Post-chunk blank // Line 18
+		// Post-chunk class // Line 18
 		// Post-chunk ref
 		// Post-chunk blank
 		// plus another when the processor adds a final \n // Line 21
 	}
 	expected := map[int]string{
-		9:  "",
+		9:  "{.chunk-refs}",
 		10: "Added to in section [2](once.html#section-2).",
 		11: "",
-		18: "",
+		18: "{.chunk-refs}",
 		19: "Added to in section [1](once.html#section-1).",
 		20: "",
 	}
@@ -124,7 +124,7 @@ func TestFinalMarkdown_ChunkRefs_AddedToTwice(t *testing.T) {
 		"``` Chunk one",
 		"Chunk content",
 		"```",
-		// Post-chunk blank // Line 9
+		// Post-chunk class // Line 9
 		// Post-chunk ref
 		// Post-chunk blank
 		"# T2",
@@ -133,7 +133,7 @@ func TestFinalMarkdown_ChunkRefs_AddedToTwice(t *testing.T) {
 		// Blank line
 		"``` Chunk one",
 		"```",
-		// Post-chunk blank // Line 18
+		// Post-chunk class // Line 18
 		// Post-chunk ref
 		// Post-chunk blank
 		"",
@@ -142,21 +142,21 @@ func TestFinalMarkdown_ChunkRefs_AddedToTwice(t *testing.T) {
 		// Blank line
 		"``` Chunk one",
 		"```",
-		// Post-chunk blank // Line 27
+		// Post-chunk class // Line 27
 		// Post-chunk ref
 		// Post-chunk blank
 		// Spare line after final \n // Line 30
 	}
 	expected := map[int]string{
-		9:  "",
+		9:  "{.chunk-refs}",
 		10: "Added to in sections [2](twice.html#section-2) and [2](twice.html#section-2).",
 		11: "",
 
-		18: "",
+		18: "{.chunk-refs}",
 		19: "Added to in sections [1](twice.html#section-1) and [2](twice.html#section-2).",
 		20: "",
 
-		27: "",
+		27: "{.chunk-refs}",
 		28: "Added to in sections [1](twice.html#section-1) and [2](twice.html#section-2).",
 		29: "",
 	}
@@ -192,7 +192,7 @@ func TestFinalMarkdown_ChunkRefs_AddedToThrice(t *testing.T) {
 		"``` Chunk one",
 		"Chunk content",
 		"```",
-		// Post-chunk blank // Line 9
+		// Post-chunk class // Line 9
 		// Post-chunk ref
 		// Post-chunk blank
 		"# T2",
@@ -201,7 +201,7 @@ func TestFinalMarkdown_ChunkRefs_AddedToThrice(t *testing.T) {
 		// Blank line
 		"``` Chunk one",
 		"```",
-		// Post-chunk blank // Line 18
+		// Post-chunk class // Line 18
 		// Post-chunk ref
 		// Post-chunk blank
 		"",
@@ -210,7 +210,7 @@ func TestFinalMarkdown_ChunkRefs_AddedToThrice(t *testing.T) {
 		// Blank line
 		"``` Chunk one",
 		"```",
-		// Post-chunk blank // Line 27
+		// Post-chunk class // Line 27
 		// Post-chunk ref
 		// Post-chunk blank
 		"# Title 3",
@@ -219,25 +219,25 @@ func TestFinalMarkdown_ChunkRefs_AddedToThrice(t *testing.T) {
 		// Blank line
 		"``` Chunk one",
 		"```",
-		// Post-chunk blank // Line 36
+		// Post-chunk class // Line 36
 		// Post-chunk ref
 		// Post-chunk blank
 		// Spare line after final \n // Line 39
 	}
 	expected := map[int]string{
-		9:  "",
+		9:  "{.chunk-refs}",
 		10: "Added to in sections [2](thrice.html#section-2), [2](thrice.html#section-2) and [3](thrice.html#section-3).",
 		11: "",
 
-		18: "",
+		18: "{.chunk-refs}",
 		19: "Added to in sections [1](thrice.html#section-1), [2](thrice.html#section-2) and [3](thrice.html#section-3).",
 		20: "",
 
-		27: "",
+		27: "{.chunk-refs}",
 		28: "Added to in sections [1](thrice.html#section-1), [2](thrice.html#section-2) and [3](thrice.html#section-3).",
 		29: "",
 
-		36: "",
+		36: "{.chunk-refs}",
 		37: "Added to in sections [1](thrice.html#section-1), [2](thrice.html#section-2) and [2](thrice.html#section-2).",
 		38: "",
 	}
@@ -353,7 +353,7 @@ func TestFinalMarkdown_ChunkRefs_UsedOnce(t *testing.T) {
 		"``` Chunk one",
 		"Chunk content",
 		"```",
-		// Post-chunk blank // Line 9
+		// Post-chunk class // Line 9
 		// Post-chunk ref
 		// Post-chunk blank
 		"# T2",
@@ -366,7 +366,7 @@ func TestFinalMarkdown_ChunkRefs_UsedOnce(t *testing.T) {
 		// plus another when the processor adds a final \n // Line 19
 	}
 	expected := map[int]string{
-		9:  "",
+		9:  "{.chunk-refs}",
 		10: "Used in section [2](once.html#section-2).",
 		11: "",
 	}
@@ -411,7 +411,7 @@ func TestFinalMarkdown_ChunkRefs_UsedTwice(t *testing.T) {
 		"``` Chunk two",
 		"  Some content here",
 		"```",
-		// Post-chunk blank // Line 18
+		// Post-chunk class // Line 18
 		// Post-chunk ref
 		// Post-chunk blank
 		"",
@@ -424,7 +424,7 @@ func TestFinalMarkdown_ChunkRefs_UsedTwice(t *testing.T) {
 		// Spare line after final \n // Line 28
 	}
 	expected := map[int]string{
-		18: "",
+		18: "{.chunk-refs}",
 		19: "Used in sections [1](twice.html#section-1) and [2](twice.html#section-2).",
 		20: "",
 	}
@@ -466,7 +466,7 @@ func TestFinalMarkdown_ChunkRefs_UsedThrice(t *testing.T) {
 		// Blank line
 		"``` Chunk two",
 		"```",
-		// Post-chunk blank // Line 15
+		// Post-chunk class // Line 15
 		// Post-chunk ref
 		// Post-chunk blank
 		"",
@@ -487,7 +487,7 @@ func TestFinalMarkdown_ChunkRefs_UsedThrice(t *testing.T) {
 		// Spare line after final \n // Line 33
 	}
 	expected := map[int]string{
-		15: "",
+		15: "{.chunk-refs}",
 		16: "Used in sections [1](thrice.html#section-1), [2](thrice.html#section-2) and [3](thrice.html#section-3).",
 		17: "",
 	}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetaField(t *testing.T) {
+	data := []struct {
+		line  string
+		key   string
+		value string
+		ok    bool
+	}{
+		{"title: My chapter", "title", "My chapter", true},
+		{"title:   Spaced out  ", "title", "Spaced out", true},
+		{`title: "Quoted: yes"`, "title", "Quoted: yes", true},
+		{"author: 'Single'", "author", "Single", true},
+		{"date: 2020-01-31", "date", "2020-01-31", true},
+		{"last_updated: today", "last_updated", "today", true},
+		{"tags:", "", "", false},
+		{"  - a tag", "", "", false},
+		{"  nested: value", "", "", false},
+		{"# A comment", "", "", false},
+		{"url:http://example.com", "", "", false},
+		{"", "", "", false},
+	}
+
+	for _, d := range data {
+		key, value, ok := metaField(d.line)
+		if key != d.key || value != d.value || ok != d.ok {
+			t.Errorf("Line %q: Expected (%q, %q, %t) but got (%q, %q, %t)",
+				d.line, d.key, d.value, d.ok, key, value, ok)
+		}
+	}
+}
+
+func TestProcessContent_FrontMatter(t *testing.T) {
+	s := newState()
+	s.setFirstInName("chapter.md")
+	d := newDoc()
+	lines := []string{
+		"---",
+		"title: Reading the markup",
+		"author: A. N. Other",
+		"tags:",
+		"  - one",
+		"---",
+		"Some text",
+		"",
+		"---",
+		"# Heading",
+	}
+	r := strings.NewReader(strings.Join(lines, "\n"))
+
+	processContent(r, &s, &d)
+
+	expMeta := map[string]string{
+		"title":  "Reading the markup",
+		"author": "A. N. Other",
+	}
+	if len(d.meta["chapter.md"]) != len(expMeta) {
+		t.Errorf("Expected metadata %#v but got %#v", expMeta, d.meta["chapter.md"])
+	}
+	for key, exp := range expMeta {
+		if d.meta["chapter.md"][key] != exp {
+			t.Errorf("Expected %s %q but got %q", key, exp, d.meta["chapter.md"][key])
+		}
+	}
+	if d.titleOf("chapter.md") != "Reading the markup" {
+		t.Errorf("Expected title from front matter but got %q",
+			d.titleOf("chapter.md"))
+	}
+
+	// Front matter is blanked out, but line numbers are preserved
+	expMarkdown := "\n\n\n\n\n\nSome text\n\n---\n# Heading\n"
+	if d.markdown["chapter.md"].String() != expMarkdown {
+		t.Errorf("Expected markdown %q but got %q",
+			expMarkdown, d.markdown["chapter.md"].String())
+	}
+	if sec, ok := d.secStarts["chapter.md"][10]; !ok || sec.toString() != "1 Heading" {
+		t.Errorf("Expected section 1 to start at line 10, but got %#v",
+			d.secStarts["chapter.md"])
+	}
+	if len(s.warnings) != 0 {
+		t.Errorf("Expected no warnings but got %#v", s.warnings)
+	}
+}
+
+func TestProcessContent_FrontMatterOnlyAtStart(t *testing.T) {
+	s := newState()
+	s.setFirstInName("chapter.md")
+	d := newDoc()
+	r := strings.NewReader("\n---\ntitle: Not front matter\n---\n")
+
+	processContent(r, &s, &d)
+
+	if len(d.meta) != 0 {
+		t.Errorf("Expected no metadata but got %#v", d.meta)
+	}
+	if !strings.Contains(d.markdown["chapter.md"].String(), "title: Not front matter") {
+		t.Errorf("Expected text in markdown but got %q", d.markdown["chapter.md"].String())
+	}
+}
+
+func TestProcessContent_FrontMatterNotClosed(t *testing.T) {
+	s := newState()
+	s.setFirstInName("chapter.md")
+	d := newDoc()
+	r := strings.NewReader("---\ntitle: Never ends\n# Heading\n")
+
+	processContent(r, &s, &d)
+
+	if len(s.warnings) != 1 {
+		t.Fatalf("Expected 1 warning but got %#v", s.warnings)
+	}
+	w := s.warnings[0]
+	if w.fName != "chapter.md" || w.line != 3 || !strings.Contains(w.msg, "front matter") {
+		t.Errorf("Expected warning about front matter at line 3, but got %#v", w)
+	}
+	if s.inFrontMatter {
+		t.Errorf("Expected front matter to be finished with the content")
+	}
+}
+
+func TestWriteHTML_FrontMatter(t *testing.T) {
+	s := newState()
+	s.setFirstInName("chapter.md")
+	d := newBuilderDoc(newDoc())
+	d.title = "The book"
+	r := strings.NewReader("---\n" +
+		"title: Fish & chips\n" +
+		"author: \"A <b>bold</b> author\"\n" +
+		"date: 2020-01-31\n" +
+		"...\n" +
+		"Some text\n")
+
+	processContent(r, &s, &d.doc)
+	if err := writeHTML("chapter.md", "chapter.html", &d.doc); err != nil {
+		t.Fatalf("writeHTML error: %s", err.Error())
+	}
+
+	out := d.outputs["chapter.html"].String()
+	expected := []string{
+		"<title>Fish &amp; chips</title>",
+		`<meta name="author" content="A &lt;b&gt;bold&lt;/b&gt; author"/>`,
+		"<p>Some text</p>",
+	}
+	for _, sub := range expected {
+		if !strings.Contains(out, sub) {
+			t.Errorf("Expected output to contain %q but got\n%s", sub, out)
+		}
+	}
+	if strings.Contains(out, "2020-01-31") {
+		t.Errorf("Expected no front matter in output but got\n%s", out)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func goIdentsTestDoc(lines []string) doc {
+	s := newState()
+	s.setFirstInName("prog.md")
+	d := newDoc()
+	for _, line := range lines {
+		s.proc(&s, &d, line)
+	}
+	d.lat = compileLattice(d.chunks)
+	d.indexGoIdents(topLevelChunks(d.lat))
+	return d
+}
+
+var goIdentsTestLines = []string{
+	"# Program",                        // 1
+	"``` main.go",                      // 2
+	"package main",                     // 3
+	"@{Types}",                         // 4
+	"func main() {",                    // 5
+	"    c := newC()",                  // 6
+	"    c.count()",                    // 7
+	"    limit := 3",                   // 8
+	"    _ = limit",                    // 9
+	"}",                                // 10
+	"```",                              // 11
+	"## Types",                         // 12
+	"``` Types",                        // 13
+	"type counter struct {",            // 14
+	"    limit int",                    // 15
+	"}",                                // 16
+	"const limit = 10",                 // 17
+	"",                                 // 18
+	"func newC() counter {",            // 19
+	"    return counter{limit: limit}", // 20
+	"}",                                // 21
+	"```",                              // 22
+	"## Methods",                       // 23
+	"``` Types",                        // 24
+	"func (c counter) count() int {",   // 25
+	"    return c.limit",               // 26
+	"}",                                // 27
+	"```",                              // 28
+	"``` notes.txt",                    // 29
+	"func notGo() {}",                  // 30
+	"```",                              // 31
+}
+
+func TestIndexGoIdents(t *testing.T) {
+	d := goIdentsTestDoc(goIdentsTestLines)
+
+	expected := map[string]struct {
+		kind string
+		defs []string
+		uses []string
+	}{
+		"main.main":          {"func", []string{"1"}, []string{}},
+		"main.newC":          {"func", []string{"1.1"}, []string{"1"}},
+		"main.counter":       {"type", []string{"1.1"}, []string{"1.1", "1.1", "1.2"}},
+		"main.limit":         {"const", []string{"1.1"}, []string{"1.1"}},
+		"main.counter.count": {"method", []string{"1.2"}, []string{"1"}},
+	}
+	names := func(secs []section) []string {
+		nums := make([]string, len(secs))
+		for i, sec := range secs {
+			nums[i] = sec.numsToString()
+		}
+		sort.Strings(nums)
+		return nums
+	}
+
+	if len(d.goIdents) != len(expected) {
+		t.Errorf("Expected %d identifiers but got %#v", len(expected), d.goIdents)
+	}
+	for name, exp := range expected {
+		ident, ok := d.goIdents[name]
+		if !ok {
+			t.Errorf("Expected identifier %q but it's not there", name)
+			continue
+		}
+		if ident.kind != exp.kind {
+			t.Errorf("Expected %q to be a %s but got %s", name, exp.kind, ident.kind)
+		}
+		if !reflect.DeepEqual(names(ident.defs), exp.defs) {
+			t.Errorf("Expected %q defined in %q but got %q",
+				name, exp.defs, names(ident.defs))
+		}
+		if !reflect.DeepEqual(names(ident.uses), exp.uses) {
+			t.Errorf("Expected %q used in %q but got %q",
+				name, exp.uses, names(ident.uses))
+		}
+	}
+}
+
+func TestIdentsChunkRef(t *testing.T) {
+	d := goIdentsTestDoc(goIdentsTestLines)
+	d.outNames["prog.md"] = "prog.html"
+
+	data := []struct {
+		lineNum int
+		exp     string
+	}{
+		{11, "\nDefines: `main`. Uses: [`counter.count`](prog.html#section-1.2), " +
+			"[`newC`](prog.html#section-1.1).\n\n"},
+		{22, "\nDefines: `counter`, `limit`, `newC`.\n\n"},
+		{28, "\nDefines: `counter.count`. Uses: [`counter`](prog.html#section-1.1).\n\n"},
+		{31, ""},
+		{10, ""},
+	}
+
+	for _, dt := range data {
+		act := identsChunkRef("prog.md", &d, dt.lineNum)
+		if act != dt.exp {
+			t.Errorf("Line %d: Expected %q but got %q", dt.lineNum, dt.exp, act)
+		}
+	}
+
+	mdown := finalMarkdown("prog.md", &d).String()
+	if !strings.Contains(mdown, "```\n{.chunk-idents}\nDefines: `main`. Uses: ") {
+		t.Errorf("Expected footer after first chunk but got\n%s", mdown)
+	}
+}
+
+func TestIdentIndex(t *testing.T) {
+	d := goIdentsTestDoc(goIdentsTestLines)
+	d.outNames["prog.md"] = "out/prog.html"
+
+	expected := "* `counter` (type): defined in section [1.1](prog.html#section-1.1); " +
+		"used in sections [1.1](prog.html#section-1.1) and [1.2](prog.html#section-1.2).\n" +
+		"* `counter.count` (method): defined in section [1.2](prog.html#section-1.2); " +
+		"used in section [1](prog.html#section-1).\n" +
+		"* `limit` (const): defined in section [1.1](prog.html#section-1.1); " +
+		"used in section [1.1](prog.html#section-1.1).\n" +
+		"* `main` (func): defined in section [1](prog.html#section-1).\n" +
+		"* `newC` (func): defined in section [1.1](prog.html#section-1.1); " +
+		"used in section [1](prog.html#section-1).\n"
+
+	act := d.identIndex("out/prog.html")
+	if act != expected {
+		t.Errorf("Expected index\n%s\nbut got\n%s", expected, act)
+	}
+}
+
+func TestIndexGoIdents_SyntaxError(t *testing.T) {
+	d := goIdentsTestDoc([]string{
+		"``` broken.go",
+		"package main",
+		"func ok() {}",
+		"func broken( {",
+		"```",
+	})
+
+	if _, ok := d.goIdents["main.ok"]; !ok {
+		t.Errorf("Expected to index up to the error but got %#v", d.goIdents)
+	}
+}
+
+func TestIndexGoIdents_MethodAndFuncWithSameName(t *testing.T) {
+	funcLines := []string{
+		"``` Func",
+		"func count() int { return 0 }",
+		"```",
+	}
+	methodLines := []string{
+		"``` Method",
+		"func (c *counter) count() int { return c.n }",
+		"```",
+	}
+	mainLines := []string{
+		"# Program",
+		"``` main.go",
+		"package main",
+		"type counter struct{ n int }",
+		"@{Method}",
+		"@{Func}",
+		"var a = count()",
+		"var b = (&counter{}).count()",
+		"```",
+	}
+
+	for _, lines := range [][]string{
+		append(append(append([]string{}, mainLines...), funcLines...), methodLines...),
+		append(append(append([]string{}, mainLines...), methodLines...), funcLines...),
+	} {
+		d := goIdentsTestDoc(lines)
+
+		fn, ok1 := d.goIdents["main.count"]
+		method, ok2 := d.goIdents["main.counter.count"]
+		if !ok1 || !ok2 {
+			t.Errorf("Expected a func and a method but got %#v", d.goIdents)
+			continue
+		}
+		if fn.kind != "func" || len(fn.defs) != 1 || len(fn.uses) != 1 {
+			t.Errorf("Expected func count defined once and used once but got %#v", fn)
+		}
+		if method.kind != "method" || len(method.defs) != 1 || len(method.uses) != 1 {
+			t.Errorf("Expected method count defined once and used once but got %#v", method)
+		}
+	}
+}
+
+func TestIndexGoIdents_Packages(t *testing.T) {
+	d := goIdentsTestDoc([]string{
+		"# Program",        // 1
+		"``` main.go",      // 2
+		"package main",     // 3
+		"func run() {}",    // 4
+		"func main() {",    // 5
+		"    run()",        // 6
+		"}",                // 7
+		"```",              // 8
+		"## Tool",          // 9
+		"``` tool/tool.go", // 10
+		"package tool",     // 11
+		"func run() {}",    // 12
+		"func Start() {",   // 13
+		"    run()",        // 14
+		"}",                // 15
+		"```",              // 16
+	})
+	d.outNames["prog.md"] = "prog.html"
+
+	for key, sec := range map[string]string{"main.run": "1", "tool.run": "1.1"} {
+		ident, ok := d.goIdents[key]
+		if !ok {
+			t.Errorf("Expected identifier %q but got %#v", key, d.goIdents)
+			continue
+		}
+		if len(ident.defs) != 1 || ident.defs[0].numsToString() != sec ||
+			len(ident.uses) != 1 || ident.uses[0].numsToString() != sec {
+			t.Errorf("Expected %q defined and used just in %s but got %#v",
+				key, sec, ident)
+		}
+	}
+
+	exp := "\nDefines: `tool.run`, `tool.Start`.\n\n"
+	if act := identsChunkRef("prog.md", &d, 16); act != exp {
+		t.Errorf("Expected %q but got %q", exp, act)
+	}
+}
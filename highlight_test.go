@@ -0,0 +1,169 @@
+package main
+
+import (
+	"github.com/gomarkdown/markdown/ast"
+	"io"
+	"strings"
+	"testing"
+)
+
+func hlKw(text string) string  { return `<span class="hl-keyword">` + text + `</span>` }
+func hlBi(text string) string  { return `<span class="hl-builtin">` + text + `</span>` }
+func hlStr(text string) string { return `<span class="hl-string">` + text + `</span>` }
+func hlNum(text string) string { return `<span class="hl-number">` + text + `</span>` }
+func hlCom(text string) string { return `<span class="hl-comment">` + text + `</span>` }
+
+func TestHighlight(t *testing.T) {
+	data := []struct {
+		lang  string
+		lines []string
+		exp   []string
+	}{
+		{"go", []string{
+			`func half(x int) float64 { // Half it`,
+			`    return float64(x) / 2.0`,
+			`}`,
+		}, []string{
+			hlKw("func") + " half(x " + hlBi("int") + ") " + hlBi("float64") + " { " +
+				hlCom("// Half it"),
+			"    " + hlKw("return") + " " + hlBi("float64") + "(x) / " + hlNum("2.0"),
+			"}",
+		}},
+		{"go", []string{
+			`s := "a \"b\" <c>" /* one`,
+			`two */ r := 'x'`,
+			"q := `raw",
+			"more`",
+			`bad := "unclosed`,
+		}, []string{
+			"s := " + hlStr(`&quot;a \&quot;b\&quot; &lt;c&gt;&quot;`) + " " + hlCom("/* one"),
+			hlCom("two */") + " r := " + hlStr("'x'"),
+			"q := " + hlStr("`raw"),
+			hlStr("more`"),
+			"bad := &quot;unclosed",
+		}},
+		{"go", []string{
+			`var π = 3.14 // Pi`,
+		}, []string{
+			hlKw("var") + " π = " + hlNum("3.14") + " " + hlCom("// Pi"),
+		}},
+		{"sh", []string{
+			`if [ -f "$HOME/x" ]; then # Check`,
+			`  echo ${NAME} $1 'it$s'#not`,
+			`fi`,
+		}, []string{
+			hlKw("if") + " [ -f " + hlStr("&quot;$HOME/x&quot;") + " ]; " + hlKw("then") +
+				" " + hlCom("# Check"),
+			"  " + hlBi("echo") + ` <span class="hl-variable">${NAME}</span> ` +
+				`<span class="hl-variable">$1</span> ` + hlStr("'it$s'") + "#not",
+			hlKw("fi"),
+		}},
+		{"json", []string{
+			`{"name": "litgo", "stars": 10, "ok": true, "none": null}`,
+		}, []string{
+			`{<span class="hl-key">&quot;name&quot;</span>: ` + hlStr("&quot;litgo&quot;") +
+				`, <span class="hl-key">&quot;stars&quot;</span>: ` + hlNum("10") +
+				`, <span class="hl-key">&quot;ok&quot;</span>: ` + hlKw("true") +
+				`, <span class="hl-key">&quot;none&quot;</span>: ` + hlKw("null") + "}",
+		}},
+		{"yaml", []string{
+			`title: My book # The title`,
+			`  - depth: 2`,
+			`draft: Yes`,
+			`url: "http://x"`,
+			`name: José`,
+		}, []string{
+			`<span class="hl-key">title</span>: My book ` + hlCom("# The title"),
+			`  - <span class="hl-key">depth</span>: ` + hlNum("2"),
+			`<span class="hl-key">draft</span>: ` + hlKw("Yes"),
+			`<span class="hl-key">url</span>: ` + hlStr("&quot;http://x&quot;"),
+			`<span class="hl-key">name</span>: José`,
+		}},
+		{"sql", []string{
+			`SELECT count(*) FROM users -- All`,
+			`where name = 'O''Neil';`,
+		}, []string{
+			hlKw("SELECT") + " " + hlBi("count") + "(*) " + hlKw("FROM") + " users " +
+				hlCom("-- All"),
+			hlKw("where") + " name = " + hlStr("'O'") + hlStr("'Neil'") + ";",
+		}},
+		{"c", []string{
+			`#include <stdio.h>`,
+			`static int n = 0x1F; /* Count */`,
+			`char c = '\'';`,
+		}, []string{
+			`<span class="hl-meta">#include &lt;stdio.h&gt;</span>`,
+			hlKw("static") + " " + hlBi("int") + " n = " + hlNum("0x1F") + "; " +
+				hlCom("/* Count */"),
+			hlBi("char") + " c = " + hlStr(`'\''`) + ";",
+		}},
+	}
+
+	for _, dt := range data {
+		st := hlState{}
+		for i, line := range dt.lines {
+			act := syntaxes[dt.lang].highlight(line, &st)
+			if act != dt.exp[i] {
+				t.Errorf("Highlighting %s line %q: Expected\n%s\nbut got\n%s",
+					dt.lang, line, dt.exp[i], act)
+			}
+		}
+	}
+}
+
+func TestHighlight_NoSyntax(t *testing.T) {
+	st := hlState{}
+	act := syntaxes["cobol"].highlight(`if x < "y" // 2`, &st)
+	exp := `if x &lt; &quot;y&quot; // 2`
+	if act != exp {
+		t.Errorf("Expected %q but got %q", exp, act)
+	}
+}
+
+func Test_RenderChunk_HighlightsAroundChunkRefs(t *testing.T) {
+	code := "/* Start\n" +
+		"  @{Middle}\n" +
+		"end */ return\n"
+	data := map[string]string{
+		"program.md": "# Section one\n" +
+			"``` main.c\n" +
+			code +
+			"```\n" +
+			"``` Middle\n" +
+			"```\n",
+	}
+
+	s := newState()
+	s.setFirstInName("program.md")
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		return stringReadCloser{strings.NewReader(data[fName])}, nil
+	}
+	d := newDoc()
+
+	firstPassForAll(&s, &d)
+	d.lat = compileLattice(d.chunks)
+
+	cb := ast.CodeBlock{
+		Leaf:     ast.Leaf{Literal: []byte(code)},
+		IsFenced: true,
+		Info:     []byte("c"),
+	}
+
+	w := strings.Builder{}
+	renderChunk(&w, &cb, &d, "program.md")
+	expected := `<pre><code class="language-c">` + hlCom("/* Start") + "\n" +
+		`  <a href="#section-1">@{Middle}</a>` + "\n" +
+		hlCom("end */") + " " + hlKw("return") + "\n" +
+		"</code></pre>"
+	if w.String() != expected {
+		t.Errorf("Expected\n%s\nbut got\n%s", expected, w.String())
+	}
+
+	// Not highlighted if we don't want it
+	d.highlight = false
+	w = strings.Builder{}
+	renderChunk(&w, &cb, &d, "program.md")
+	if strings.Contains(w.String(), "<span") {
+		t.Errorf("Expected no highlighting but got\n%s", w.String())
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func lineNumbersTestDoc(t *testing.T, lineNumbers string) builderDoc {
+	data := map[string]string{
+		"prog.md": "# Prog\n" + // 1
+			"``` main.go\n" + // 2
+			"package main\n" + // 3
+			"@{Body}\n" + // 4
+			"```\n" + // 5
+			"``` Body\n" + // 6
+			"func x() {}\n" + // 7
+			"func y() {}\n" + // 8
+			"```\n", // 9
+	}
+
+	s := newState()
+	s.setFirstInName("prog.md")
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		return stringReadCloser{strings.NewReader(data[fName])}, nil
+	}
+	d := newBuilderDoc(newDoc())
+	d.lineNumbers = lineNumbers
+
+	if err := firstPassForAll(&s, &d.doc); err != nil {
+		t.Fatalf("Error on first pass for all: %s", err.Error())
+	}
+	d.lat = compileLattice(d.chunks)
+	return d
+}
+
+func TestFenceInfo(t *testing.T) {
+	data := []struct {
+		info  string
+		lang  string
+		start int
+	}{
+		{"go", "go", 0},
+		{"", "", 0},
+		{"go line=12", "go", 12},
+		{"line=3", "", 3},
+		{"2", "2", 0},
+		{"go line=x", "go line=x", 0},
+		{"go outline=4", "go outline=4", 0},
+	}
+
+	for _, dt := range data {
+		lang, start := fenceInfo(dt.info)
+		if lang != dt.lang || start != dt.start {
+			t.Errorf("Info %q: Expected %q and %d but got %q and %d",
+				dt.info, dt.lang, dt.start, lang, start)
+		}
+	}
+}
+
+func TestFinalMarkdown_CodingLanguage_LineNumbers(t *testing.T) {
+	d := lineNumbersTestDoc(t, "source")
+
+	if err := writeAllMarkdown(d.inNames, &d.doc); err != nil {
+		t.Fatalf("Error writing markdown: %s", err.Error())
+	}
+	out := d.outputs["prog.html"].String()
+	for _, sub := range []string{
+		`<pre><code class="language-go"><a class="line-number" id="L3" href="#L3">3</a>` +
+			hlKw("package") + " main\n" +
+			`<a class="line-number" id="L4" href="#L4">4</a><a href="#section-1">@{Body}</a>`,
+		`<a class="line-number" id="L8" href="#L8">8</a>` + hlKw("func") + " y() {}\n",
+	} {
+		if !strings.Contains(out, sub) {
+			t.Errorf("Expected output to contain\n%s\nbut got\n%s", sub, out)
+		}
+	}
+
+	// No line numbers by default
+	d = lineNumbersTestDoc(t, "none")
+	if err := writeAllMarkdown(d.inNames, &d.doc); err != nil {
+		t.Fatalf("Error writing markdown: %s", err.Error())
+	}
+	out = d.outputs["prog.html"].String()
+	if strings.Contains(out, "line-number") || strings.Contains(out, "line=") {
+		t.Errorf("Expected no line numbers but got\n%s", out)
+	}
+}
+
+func TestWriteChunks_RecordsOutLines(t *testing.T) {
+	d := lineNumbersTestDoc(t, "output")
+	d.commentStyle = "// %s"
+	d.lineDir = "//line %f:%l"
+
+	if err := d.writeChunks(topLevelChunks(d.lat), "prog.md"); err != nil {
+		t.Fatalf("Error writing chunks: %s", err.Error())
+	}
+
+	// main.go is:
+	// 1 // main.go
+	// 2 //line prog.md:3
+	// 3 package main
+	// 4 // Body
+	// 5 //line prog.md:7
+	// 6 func x() {}
+	// 7 //line prog.md:8
+	// 8 func y() {}
+	expected := map[int]outLine{
+		3: {"main.go", 3},
+		7: {"main.go", 6},
+		8: {"main.go", 8},
+	}
+	if !reflect.DeepEqual(d.outLines["prog.md"], expected) {
+		t.Errorf("Expected output lines %#v but got %#v",
+			expected, d.outLines["prog.md"])
+	}
+
+	// Nothing recorded if we don't need it
+	d = lineNumbersTestDoc(t, "source")
+	if err := d.writeChunks(topLevelChunks(d.lat), "prog.md"); err != nil {
+		t.Fatalf("Error writing chunks: %s", err.Error())
+	}
+	if len(d.outLines) != 0 {
+		t.Errorf("Expected no output lines but got %#v", d.outLines)
+	}
+}
+
+func TestLineNumber(t *testing.T) {
+	d := lineNumbersTestDoc(t, "output")
+	d.outLines["prog.md"] = map[int]outLine{7: {"cmd/main.go", 6}}
+
+	data := []struct {
+		lineNumbers string
+		singlePage  bool
+		lNum        int
+		exp         string
+	}{
+		{"source", false, 7, `<a class="line-number" id="L7" href="#L7">7</a>`},
+		{"source", true, 7,
+			`<a class="line-number" id="file-prog-md-L7" href="#file-prog-md-L7">7</a>`},
+		{"output", false, 7, `<a class="line-number" id="cmd-main-go-L6" ` +
+			`href="#cmd-main-go-L6" title="cmd/main.go:6">6</a>`},
+		{"output", true, 7, `<a class="line-number" id="cmd-main-go-L6" ` +
+			`href="#cmd-main-go-L6" title="cmd/main.go:6">6</a>`},
+		{"output", false, 4, `<span class="line-number"></span>`},
+	}
+
+	for _, dt := range data {
+		d.lineNumbers = dt.lineNumbers
+		d.singlePage = dt.singlePage
+		act := d.lineNumber("prog.md", dt.lNum)
+		if act != dt.exp {
+			t.Errorf("Numbering %s, single page %v, line %d: Expected\n%s\nbut got\n%s",
+				dt.lineNumbers, dt.singlePage, dt.lNum, dt.exp, act)
+		}
+	}
+}
+
+func TestWriteHTML_OutputLineNumbers(t *testing.T) {
+	d := lineNumbersTestDoc(t, "output")
+
+	if err := d.writeChunks(topLevelChunks(d.lat), "prog.md"); err != nil {
+		t.Fatalf("Error writing chunks: %s", err.Error())
+	}
+	if err := writeAllMarkdown(d.inNames, &d.doc); err != nil {
+		t.Fatalf("Error writing markdown: %s", err.Error())
+	}
+
+	out := d.outputs["prog.html"].String()
+	expected := `<pre><code class="language-go">` +
+		`<a class="line-number" id="main-go-L1" href="#main-go-L1" title="main.go:1">1</a>` +
+		hlKw("package") + " main\n" +
+		`<span class="line-number"></span><a href="#section-1">@{Body}</a>` + "\n" +
+		"</code></pre>"
+	if !strings.Contains(out, expected) {
+		t.Errorf("Expected output to contain\n%s\nbut got\n%s", expected, out)
+	}
+	if !strings.Contains(out, `title="main.go:3">3</a>`+hlKw("func")+" y() {}") {
+		t.Errorf("Expected func y() at main.go:3 but got\n%s", out)
+	}
+}
+
+func TestProcForLineNumbersDirective(t *testing.T) {
+	s := newState()
+	s.setFirstInName("prog.md")
+	d := newDoc()
+
+	s.proc(&s, &d, "@line-numbers output")
+	if d.lineNumbers != "output" {
+		t.Errorf("Expected output line numbers but got %q", d.lineNumbers)
+	}
+
+	s.proc(&s, &d, "@line-numbers every")
+	if d.lineNumbers != "output" || len(s.warnings) != 1 || s.warnings[0].line != 2 {
+		t.Errorf("Expected a warning at line 2 and no change but got %q and %#v",
+			d.lineNumbers, s.warnings)
+	}
+}
@@ -3,12 +3,19 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/gomarkdown/markdown"
 	"github.com/gomarkdown/markdown/ast"
 	"github.com/gomarkdown/markdown/html"
 	"github.com/gomarkdown/markdown/parser"
+	goast "go/ast"
+	goparser "go/parser"
+	"go/token"
+	"html/template"
 	"io"
 	"os"
 	"path/filepath"
@@ -18,24 +25,43 @@ import (
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 // Package level declarations
 type state struct {
 	// Tracking
-	book    string // Name of the top level book file, or empty if none.
-	inName  string // Name of file being processed, relative to working dir
-	outName string // Name of final file to write to
+	book      string            // Name of the current file if it's a book, or empty if not
+	bookDepth int               // Files above this depth are books, if the top one is
+	bookOf    map[string]string // The book file each chapter is linked from
+	linkedAt  map[string]place  // Where each chapter is linked from or listed
+	inName    string            // Name of file being processed, relative to working dir
+	outName   string            // Name of final file to write to
 	// Name of all input files, including the first, relative to working dir
-	inNames   []string
-	lineNum   int                        // Current line number
-	chunkName string                     // Name of current chunk
-	inChunk   bool                       // If we're currently reading a chunk
-	warnings  []warning                  // Warnings we're collecting
-	sec       section                    // Current section being read
-	proc      func(*state, *doc, string) // Function for processing a line
+	inNames       []string
+	lineNum       int                        // Current line number
+	chunkName     string                     // Name of current chunk
+	inChunk       bool                       // If we're currently reading a chunk
+	inFence       bool                       // If we're currently in a fenced block that's not a chunk
+	inFrontMatter bool                       // If we're currently in a file's front matter
+	block         string                     // Kind of markdown block we're in: "para", "other" or none
+	htmlEnd       string                     // What ends the HTML block we're in, if we're in one
+	prevLine      string                     // The previous line
+	setext        bool                       // If the current line is a setext heading's underline
+	shown         []int                      // The numbers shown for the current section, at each level
+	numberedIn    string                     // The file where we last numbered a section
+	chapter       int                        // The number of the current chapter, if we number them
+	appendix      bool                       // If we're in the appendices
+	warnings      []warning                  // Warnings we're collecting
+	sec           section                    // Current section being read
+	fixed         set                        // Options fixed by the command line, so not by directives
+	dialect       string                     // Input dialect for all files, or empty to use extensions
+	translate     translator                 // Translator of the current input file's syntax
+	proc          func(*state, *doc, string) // Function for processing a line
 	// Function for reading a named content source (e.g. a file)
 	reader func(fName string) (io.ReadCloser, error)
+	// Function for finding the files which match a pattern
+	glob func(pattern string) ([]string, error)
 }
 
 type doc struct {
@@ -49,14 +75,57 @@ type doc struct {
 	lat       lattice // A lattice of chunk parent/child relationships
 	// Lines where a section starts, per input file
 	secStarts map[string]map[int]section
+	// Lines which are the text of setext headings, per input file
+	setextStarts map[string]map[int]bool
+	labels       map[string]section // Sections by their labels
+	// Labels of sections referred to, by line, per input file
+	secRefs map[string]map[int][]string
 	// Map of normalised input file names to output names
 	outNames map[string]string
+	inNames  []string          // All the input files, in the order they were read
+	bookOf   map[string]string // The book file each chapter is linked from
+	// Lines which became more than one line of markdown, and how many,
+	// per input file
+	parts map[string]map[int]int
+	// Lines where generated content (such as contents) goes, per input file
+	generated map[string]map[int]string
 	// Config
-	lineDir    string // The string pattern for line directives
-	codeOutDir string // Output directory for the source code
-	docOutDir  string // Output directory for the translated markdown
+	title        string                       // Title of the document, or empty if none
+	titles       map[string]string            // Titles of individual input files
+	meta         map[string]map[string]string // Front matter, per input file
+	lineDir      string                       // The string pattern for line directives
+	commentStyle string                       // The pattern for comments naming a chunk in code
+	strict       bool                         // If warnings should stop us writing anything
+	searchable   bool                         // If we write a search index and search boxes
+	template     *template.Template           // Template for pages, or nil for our own
+	builtinCSS   bool                         // If we write and link to our own stylesheet
+	inlineCSS    bool                         // If stylesheets go into the pages, rather than links
+	singlePage   bool                         // If all the input files go into one output file
+	highlight    bool                         // If we highlight the code in the pages
+	lineNumbers  string                       // How to number code lines: none, source or output
+	// Where each code line went in the code output, by line, per input file
+	outLines    map[string]map[int]outLine
+	stylesheets []string                  // Other stylesheets, relative to the doc out dir
+	search      map[string][]*searchEntry // What can be searched, per input file
+	searchSec   map[string]*searchEntry   // Latest section searched, per input file
+	numbering   string                    // How to number sections: all, none or chapters
+	numberFrom  int                       // The first heading level to number
+	anchors     string                    // How to anchor sections and chunks: numbers or text
+	// Text anchors of sections, by their numbered anchors, per input file
+	slugs      map[string]map[string]string
+	chunkSlugs map[string]string // Text anchors of chunks, by name
+	// Text anchors of the later definitions of chunks, by index, per chunk
+	defSlugs map[string]map[int]string
+	goIdents map[string]*goIdent // Go identifiers, by goKey
+	goPkgs   set                 // Packages of the Go identifiers
+	// Go identifiers in each code block, by the line it ends, per input file
+	blockIdents map[string]map[int]*blockIdents
+	codeOutDir  string // Output directory for the source code
+	docOutDir   string // Output directory for the translated markdown
 	// Function for opening a file to write to and close
 	writeCloser func(string) (io.WriteCloser, error)
+	// Function for opening an output file to read what's there already
+	outReader func(string) (io.ReadCloser, error)
 }
 
 type warning struct {
@@ -65,10 +134,43 @@ type warning struct {
 	msg   string
 }
 
+// A place in an input file, such as where a chapter is linked from
+type place struct {
+	fName string
+	line  int
+}
+
 type section struct {
-	inName string
-	nums   []int
-	text   string
+	inName     string
+	nums       []int // How many headings at each level, up to this one
+	text       string
+	number     string // The number to show, if it's not just the nums
+	unnumbered bool   // If the section has no number shown
+}
+
+// Tags which start HTML blocks
+var htmlBlockTags = []string{
+	"address", "article", "aside", "blockquote", "canvas", "details",
+	"div", "dl", "fieldset", "figcaption", "figure", "footer", "form",
+	"h1", "h2", "h3", "h4", "h5", "h6", "header", "hgroup", "iframe",
+	"main", "math", "nav", "noscript", "ol", "p", "pre", "script",
+	"section", "style", "table", "ul", "video",
+}
+
+// A translator turns a line of input into a line of markdown
+type translator func(s *state, line string) string
+
+var dialects = map[string]translator{
+	"markdown": fromMarkdown,
+	"literate": fromLiterate,
+	"noweb":    fromNoweb,
+	"org":      fromOrg,
+}
+
+var dialectExts = map[string]string{
+	".lit": "literate",
+	".nw":  "noweb",
+	".org": "org",
 }
 
 type chunk struct {
@@ -101,21 +203,596 @@ type lattice struct {
 	parentsOf  map[string]set
 }
 
+// A line in a code output file
+type outLine struct {
+	file string // The top level chunk name, which is the file name
+	line int
+}
+
+// What a page's template can use
+type pageData struct {
+	Title         string
+	BookTitle     string
+	Head          template.HTML
+	Body          template.HTML
+	Stylesheet    string
+	Stylesheets   []string
+	Style         template.CSS
+	Sections      []pageSection
+	Prev          *pageLink
+	Next          *pageLink
+	Contents      *pageLink
+	Breadcrumb    []pageLink
+	SearchBox     template.HTML
+	SearchScripts template.HTML
+}
+
+// A section starting on a page
+type pageSection struct {
+	Number string
+	Title  string
+	Level  int
+	Link   string
+}
+
+// A link to another page
+type pageLink struct {
+	Title string
+	Link  string
+}
+
+var defaultTemplate = template.Must(template.New("page").Parse(
+	`<html><head>
+    {{.Head}}{{range .Stylesheets}}<link href="{{.}}" rel="stylesheet"/>
+    {{end}}{{with .Style}}<style>{{.}}</style>
+    {{end}}</head>
+    <body>{{template "nav" .}}{{.SearchBox}}{{.Body}}` +
+		`{{template "nav" .}}{{.SearchScripts}}</body></html>` +
+		`{{define "nav"}}{{if or .Prev .Next .Contents (gt (len .Breadcrumb) 1)}}<nav class="page-nav">
+    <span class="breadcrumb">` +
+		`{{range $i, $crumb := .Breadcrumb}}{{if $i}} &rsaquo; {{end}}` +
+		`<a href="{{.Link}}">{{.Title}}</a>{{end}}</span>
+    <span class="nav-links">` +
+		`{{with .Prev}}<a rel="prev" href="{{.Link}}">&larr; {{.Title}}</a>{{end}}` +
+		`{{with .Contents}} <a rel="contents" href="{{.Link}}">{{.Title}}</a>{{end}}` +
+		`{{with .Next}} <a rel="next" href="{{.Link}}">{{.Title}} &rarr;</a>{{end}}` +
+		`</span>
+    </nav>
+    {{end}}{{end}}`))
+
+// A section or chunk which can be searched for
+type searchEntry struct {
+	Kind   string `json:"kind"`   // section or chunk
+	Number string `json:"number"` // Number of the section
+	Title  string `json:"title"`  // Section title or chunk name
+	Text   string `json:"text"`   // Text of the section or code of the chunk
+	Link   string `json:"link"`
+}
+
+const searchScript = `(function() {
+    var index = window.litgoSearchIndex || [];
+    var form = document.querySelector("form.search");
+    if (!form) {
+        return;
+    }
+    var input = form.querySelector("input");
+    var results = form.querySelector(".search-results");
+    var base = form.getAttribute("data-base") || "";
+
+    function score(entry, words) {
+        var title = (entry.number + " " + entry.title).toLowerCase();
+        var text = entry.text.toLowerCase();
+        var total = 0;
+        for (var i = 0; i < words.length; i++) {
+            if (title.indexOf(words[i]) >= 0) {
+                total += 10;
+            } else if (text.indexOf(words[i]) >= 0) {
+                total += 1;
+            } else {
+                return 0;
+            }
+        }
+        return total;
+    }
+
+    function snippet(text, word) {
+        var i = text.toLowerCase().indexOf(word);
+        if (i < 0) {
+            return "";
+        }
+        var start = Math.max(0, i - 40);
+        return (start > 0 ? "..." : "") + text.substr(start, 100) + "...";
+    }
+
+    function search() {
+        var words = input.value.toLowerCase().split(/\s+/).filter(function(w) {
+            return w != "";
+        });
+        results.innerHTML = "";
+        if (words.length == 0) {
+            return;
+        }
+        var found = [];
+        for (var i = 0; i < index.length; i++) {
+            var s = score(index[i], words);
+            if (s > 0) {
+                found.push({entry: index[i], score: s, order: i});
+            }
+        }
+        found.sort(function(a, b) {
+            return b.score - a.score || a.order - b.order;
+        });
+        found.slice(0, 20).forEach(function(f) {
+            var item = document.createElement("li");
+            var link = document.createElement("a");
+            link.href = base + f.entry.link;
+            link.textContent = f.entry.kind == "chunk" ?
+                "@{" + f.entry.title + "}" :
+                (f.entry.number + " " + f.entry.title).trim();
+            item.appendChild(link);
+            var text = document.createElement("span");
+            text.textContent = " " + snippet(f.entry.text, words[0]);
+            item.appendChild(text);
+            results.appendChild(item);
+        });
+        if (found.length == 0) {
+            var none = document.createElement("li");
+            none.textContent = "Nothing found";
+            results.appendChild(none);
+        }
+    }
+
+    input.addEventListener("input", search);
+    form.addEventListener("submit", function(e) {
+        e.preventDefault();
+        search();
+    });
+})();
+`
+
+// A Go identifier, and the sections where it's defined and used
+type goIdent struct {
+	name string // With the receiver's type first if it's a method
+	pkg  string
+	kind string // func, method, type, var or const
+	defs []section
+	uses []section
+}
+
+// The Go identifiers defined and used in a code block, by goKey
+type blockIdents struct {
+	defines set
+	uses    set
+}
+
+// An identifier declared at the package level of a Go file
+type goDef struct {
+	id   *goast.Ident
+	kind string
+	recv string // The receiver's type name, if it's a method
+}
+
+// A line of tangled code, and the chunk line it came from
+type tangledLine struct {
+	code  string
+	chunk string
+	cont  chunkCont
+}
+
+// A parsed Go file, and the chunk lines it came from
+type goFile struct {
+	file  *goast.File
+	fset  *token.FileSet
+	lines []tangledLine
+}
+
+// How to pick out the tokens of a language for highlighting
+type syntax struct {
+	keywords     set
+	builtins     set
+	caseless     bool      // If keywords and built-ins can be in any case
+	lineComments []string  // What starts a comment to the end of the line
+	wordComments bool      // If line comments must start a word
+	blockComment [2]string // What starts and ends a block comment
+	quotes       string    // What quotes a string (or a character)
+	multiline    string    // Quotes whose strings can run over several lines
+	raw          string    // Quotes whose strings have no backslash escapes
+	meta         string    // What starts a line for the preprocessor
+	variables    bool      // If $ starts a variable
+	keys         bool      // If a string before a colon is a key
+	lineKeys     bool      // If a name before a colon at the start of a line is a key
+}
+
+// Where highlighting got to at the end of the last line
+type hlState struct {
+	closer string // What ends the comment or string we're in, if any
+	class  string // The class of the comment or string we're in
+}
+
+var goSyntax = &syntax{
+	keywords: setOf("break case chan const continue default defer else " +
+		"fallthrough for func go goto if import interface map package " +
+		"range return select struct switch type var"),
+	builtins: setOf("any bool byte complex64 complex128 error float32 " +
+		"float64 int int8 int16 int32 int64 rune string uint uint8 uint16 " +
+		"uint32 uint64 uintptr true false iota nil append cap close " +
+		"complex copy delete imag len make new panic print println real " +
+		"recover"),
+	lineComments: []string{"//"},
+	blockComment: [2]string{"/*", "*/"},
+	quotes:       "\"'`",
+	multiline:    "`",
+	raw:          "`",
+}
+
+var shellSyntax = &syntax{
+	keywords: setOf("if then else elif fi for while until do done case " +
+		"esac in function select time return local export"),
+	builtins: setOf("echo printf read cd exit set unset shift source eval " +
+		"exec trap test true false"),
+	lineComments: []string{"#"},
+	wordComments: true,
+	quotes:       "\"'",
+	multiline:    "\"'",
+	raw:          "'",
+	variables:    true,
+}
+
+var jsonSyntax = &syntax{
+	keywords: setOf("true false null"),
+	quotes:   "\"",
+	keys:     true,
+}
+
+var yamlSyntax = &syntax{
+	keywords:     setOf("true false null yes no on off"),
+	caseless:     true,
+	lineComments: []string{"#"},
+	wordComments: true,
+	quotes:       "\"'",
+	raw:          "'",
+	keys:         true,
+	lineKeys:     true,
+}
+
+var sqlSyntax = &syntax{
+	keywords: setOf("select from where insert into values update set " +
+		"delete create table drop alter add column index primary key " +
+		"foreign references join left right inner outer full cross on as " +
+		"and or not null is in exists between like order by group having " +
+		"limit offset union all distinct case when then else end begin " +
+		"commit rollback transaction default unique check constraint view " +
+		"if returning with asc desc"),
+	builtins: setOf("int integer bigint smallint text varchar char boolean " +
+		"date time timestamp real float double numeric decimal serial blob " +
+		"count sum avg min max coalesce true false"),
+	caseless:     true,
+	lineComments: []string{"--"},
+	blockComment: [2]string{"/*", "*/"},
+	quotes:       "'\"",
+}
+
+var cSyntax = &syntax{
+	keywords: setOf("auto break case const continue default do else enum " +
+		"extern for goto if inline register restrict return sizeof static " +
+		"struct switch typedef union volatile while"),
+	builtins: setOf("void char short int long float double signed unsigned " +
+		"bool _Bool size_t NULL true false"),
+	lineComments: []string{"//"},
+	blockComment: [2]string{"/*", "*/"},
+	quotes:       "\"'",
+	meta:         "#",
+}
+
+// The syntax of each language we can highlight, by its name
+// in a chunk's language- class
+var syntaxes = map[string]*syntax{
+	"go":   goSyntax,
+	"sh":   shellSyntax,
+	"bash": shellSyntax,
+	"zsh":  shellSyntax,
+	"json": jsonSyntax,
+	"yaml": yamlSyntax,
+	"yml":  yamlSyntax,
+	"sql":  sqlSyntax,
+	"c":    cSyntax,
+	"h":    cSyntax,
+}
+
+const builtinStylesheet = `
+body {
+    max-width: 50em;
+    margin: 0 auto;
+    padding: 1em 2em;
+    font-family: Georgia, "Times New Roman", serif;
+    line-height: 1.5;
+    color: #222222;
+    background-color: #ffffff;
+}
+a {
+    color: #1a4fa0;
+}
+h1, h2, h3, h4, h5, h6 {
+    font-family: Helvetica, Arial, sans-serif;
+    line-height: 1.2;
+}
+
+/* Navigation between pages */
+.page-nav {
+    display: flex;
+    flex-wrap: wrap;
+    justify-content: space-between;
+    margin: 1em 0;
+    padding: 0.4em 0;
+    font-family: Helvetica, Arial, sans-serif;
+    font-size: 0.9em;
+    border-top: 1px solid #d8d8e8;
+    border-bottom: 1px solid #d8d8e8;
+}
+.page-nav a {
+    text-decoration: none;
+}
+.breadcrumb a:last-child {
+    font-weight: bold;
+}
+
+/* Code */
+code, pre, .chunk-name {
+    font-family: Menlo, Consolas, "DejaVu Sans Mono", monospace;
+    font-size: 0.9em;
+}
+pre {
+    padding: 0.75em 1em;
+    overflow-x: auto;
+    line-height: 1.4;
+    background-color: #f6f6fa;
+    border: 1px solid #d8d8e8;
+}
+pre code {
+    font-size: 1em;
+}
+pre a {
+    text-decoration: none;
+    border-bottom: 1px dotted;
+}
+pre .line-number {
+    display: inline-block;
+    min-width: 3em;
+    margin-right: 1em;
+    text-align: right;
+    color: #9a9aaa;
+    border-bottom: none;
+    user-select: none;
+}
+
+/* Highlighted code */
+.hl-keyword {
+    color: #7a1f8f;
+    font-weight: bold;
+}
+.hl-builtin {
+    color: #1f5f8f;
+}
+.hl-string {
+    color: #2e7d32;
+}
+.hl-number {
+    color: #b35900;
+}
+.hl-comment {
+    color: #6a6a6a;
+    font-style: italic;
+}
+.hl-meta {
+    color: #8f1f3f;
+}
+.hl-key {
+    color: #1f5f8f;
+}
+.hl-variable {
+    color: #8f5f00;
+}
+
+/* A chunk's name is the header for its code */
+.chunk-name {
+    margin: 1.5em 0 0 0;
+    padding: 0.2em 1em;
+    font-weight: bold;
+    background-color: #e0e0ff;
+    border: 1px solid #d8d8e8;
+    border-bottom: none;
+}
+.chunk-name + pre {
+    margin-top: 0;
+}
+
+/* Where else a chunk is, and what identifiers it has */
+.chunk-refs, .chunk-idents {
+    margin: 0.25em 0;
+    font-size: 0.85em;
+    color: #5a5a5a;
+}
+.chunk-cont {
+    margin-left: 1em;
+    font-weight: normal;
+    font-size: 0.85em;
+    color: #5a5a5a;
+}
+
+/* Search */
+.search input {
+    width: 100%;
+    padding: 0.3em;
+    font-size: 1em;
+}
+.search-results {
+    padding: 0.5em 2em;
+    border: 1px solid #d8d8e8;
+}
+.search-results:empty {
+    display: none;
+}
+
+@media (prefers-color-scheme: dark) {
+    body {
+        color: #dddddd;
+        background-color: #1c1c20;
+    }
+    a {
+        color: #8ab4f8;
+    }
+    pre {
+        background-color: #26262e;
+        border-color: #3a3a48;
+    }
+    .page-nav {
+        border-color: #3a3a48;
+    }
+    .chunk-name {
+        background-color: #30305a;
+        border-color: #3a3a48;
+    }
+    .chunk-refs, .chunk-idents, .chunk-cont {
+        color: #aaaaaa;
+    }
+    pre .line-number {
+        color: #6a6a7a;
+    }
+    .hl-keyword {
+        color: #d09ef0;
+    }
+    .hl-builtin, .hl-key {
+        color: #8ac4f0;
+    }
+    .hl-string {
+        color: #9ed49e;
+    }
+    .hl-number {
+        color: #f0b070;
+    }
+    .hl-comment {
+        color: #9a9a9a;
+    }
+    .hl-meta {
+        color: #f08aa8;
+    }
+    .hl-variable {
+        color: #e0c070;
+    }
+    .search-results {
+        border-color: #3a3a48;
+    }
+}
+
+@media print {
+    body {
+        max-width: none;
+        padding: 0;
+        font-size: 11pt;
+        color: #000000;
+        background-color: #ffffff;
+    }
+    a {
+        color: inherit;
+        text-decoration: none;
+    }
+    pre {
+        white-space: pre-wrap;
+        background-color: #ffffff;
+        border-color: #999999;
+    }
+    .chunk-name {
+        background-color: #eeeeee;
+        border-color: #999999;
+        break-after: avoid;
+        page-break-after: avoid;
+    }
+    pre, .chunk-name, .chunk-refs, .chunk-idents {
+        break-inside: avoid;
+        page-break-inside: avoid;
+    }
+    .search, .search-results, .page-nav {
+        display: none;
+    }
+}
+`
+
+// Stylesheets written by older versions, which we can overwrite
+var oldStylesheets = []string{
+	`
+    .chunk-name {
+        background-color: #e0e0ff;
+    }
+`,
+	`
+    .chunk-name {
+        background-color: #e0e0ff;
+    }
+    .search-results:empty {
+        display: none;
+    }
+`,
+}
+
 var book bool
+var bookDepth int
 var lDir string
+var commentStyle string
+var dialect string
 var codeOutDir string
 var docOutDir string
 var outDir string
+var manifest string
+var strict bool
+var search bool
+var numbering string
+var numberFrom int
+var anchors string
+var templateFile string
+var cssFiles listFlag
+var builtinCSS bool
+var highlight bool
+var lineNumbers string
+var singlePage bool
+var inlineCSS bool
+
+// A flag which can be given more than once
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
 
 // Functions
 
 func init() {
 	// Flag initialisation
 	flag.BoolVar(&book, "book", false, "If the input file is a book")
+	flag.IntVar(&bookDepth, "book-depth", 1, "How many levels of files are books")
 	flag.StringVar(&lDir, "line-dir", "", "Pattern for line directives")
+	flag.StringVar(&commentStyle, "comment-style", "", "Pattern for chunk name comments in code")
+	flag.StringVar(&dialect, "dialect", "", "Syntax of the input files")
 	flag.StringVar(&codeOutDir, "code-out-dir", "", "Directory for code output")
 	flag.StringVar(&docOutDir, "doc-out-dir", "", "Directory for documentation output")
 	flag.StringVar(&outDir, "out-dir", "", "Directory for code and documentation output")
+	flag.StringVar(&manifest, "manifest", "", "File listing the input files")
+	flag.BoolVar(&strict, "strict", false, "If warnings should fail the command")
+	flag.BoolVar(&search, "search", false, "If pages should have a search box")
+	flag.StringVar(&numbering, "numbering", "all", "How to number sections")
+	flag.IntVar(&numberFrom, "number-from", 1, "First heading level to number")
+	flag.StringVar(&anchors, "anchors", "numbers", "How to anchor sections and chunks")
+	flag.StringVar(&templateFile, "template", "", "HTML template for the pages")
+	flag.Var(&cssFiles, "css", "Stylesheet to add to the pages")
+	flag.BoolVar(&builtinCSS, "builtin-css", true, "If pages should use our own stylesheet")
+	flag.BoolVar(&highlight, "highlight", true, "If code in the pages should be highlighted")
+	flag.StringVar(&lineNumbers, "line-numbers", "none", "How to number lines of code in the pages")
+	flag.BoolVar(&singlePage, "single-page", false, "If all the input files should be one page")
+	flag.BoolVar(&inlineCSS, "inline-css", false, "If stylesheets should go into the pages")
 
 }
 
@@ -126,6 +803,27 @@ func main() {
 
 	// Update the structs according to the command line
 	flag.Parse()
+	if _, ok := dialects[dialect]; dialect != "" && !ok {
+		fmt.Printf("Unknown dialect %s\n\n", dialect)
+		printHelp()
+		return
+	}
+	s.dialect = dialect
+	if !validNumbering(numbering) || numberFrom < 1 || numberFrom > 6 {
+		fmt.Print("Numbering must be all, none or chapters, from level 1 to 6\n\n")
+		printHelp()
+		return
+	}
+	if anchors != "numbers" && anchors != "text" {
+		fmt.Print("Anchors must be numbers or text\n\n")
+		printHelp()
+		return
+	}
+	if !validLineNumbers(lineNumbers) {
+		fmt.Print("Line numbers must be none, source or output\n\n")
+		printHelp()
+		return
+	}
 	if flag.NArg() == 0 {
 		s.setFirstInName("-")
 	} else if flag.NArg() == 1 {
@@ -135,12 +833,38 @@ func main() {
 		printHelp()
 		return
 	}
+	if manifest != "" && flag.NArg() > 0 {
+		fmt.Print("Give a manifest or an input file, but not both\n\n")
+		printHelp()
+		return
+	}
 
 	if book {
 		s.book = s.inName
 	}
+	s.bookDepth = bookDepth
 
 	d.lineDir = lDir
+	d.commentStyle = commentStyle
+	d.strict = strict
+	d.searchable = search
+	d.numbering = numbering
+	d.numberFrom = numberFrom
+	d.anchors = anchors
+	if templateFile != "" {
+		tmpl, err := s.readTemplate(templateFile)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		d.template = tmpl
+	}
+	d.builtinCSS = builtinCSS
+	d.stylesheets = cssFiles
+	d.highlight = highlight
+	d.lineNumbers = lineNumbers
+	d.singlePage = singlePage
+	d.inlineCSS = inlineCSS
 
 	// Use the "quick" out dir if code and doc out dirs aren't specified
 	if codeOutDir == "" {
@@ -162,6 +886,21 @@ func main() {
 	}
 	d.docOutDir = docOutDir
 
+	// Options on the command line can't be changed by directives
+	flag.Visit(func(f *flag.Flag) { s.fixed[f.Name] = true })
+	if s.fixed["out-dir"] {
+		s.fixed["code-out-dir"] = true
+		s.fixed["doc-out-dir"] = true
+	}
+
+	// A manifest replaces the input file, once we know the doc out dir
+	if manifest != "" {
+		if err := s.readManifest(&d, manifest); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+	}
+
 	// Read the content
 	// Do a first pass through all the content
 	if err := firstPassForAll(&s, &d); err != nil {
@@ -192,6 +931,10 @@ func main() {
 	for _, w := range s.warnings {
 		fmt.Printf("%s: %d: %s\n", w.fName, w.line, w.msg)
 	}
+	if d.strict && len(s.warnings) > 0 {
+		fmt.Println("Stopping because of warnings in strict mode")
+		os.Exit(1)
+	}
 
 	// Write out the code files
 	top := topLevelChunks(d.lat)
@@ -201,12 +944,39 @@ func main() {
 		return
 	}
 
+	// Index the Go identifiers
+	d.indexGoIdents(topLevelChunks(d.lat))
+
 	// Write out the markdown as HTML
 	if err := writeAllMarkdown(s.inNames, &d); err != nil {
 		fmt.Println(err.Error())
 		return
 	}
 
+	// Write out the contents page
+	if err := writeContents(&d); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	// Write out the chunk index page
+	if err := writeChunkIndex(&d); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	// Write out the identifier index page
+	if err := writeIdentIndex(&d); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	// Write out the search index
+	if err := writeSearchIndex(&d); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
 	// Write out the stylesheet
 	if err := writeStylesheet(&d); err != nil {
 		fmt.Println(err.Error())
@@ -217,26 +987,58 @@ func main() {
 
 func newState() state {
 	return state{
-		proc:   proc,
-		reader: fileReader,
+		bookDepth: 1,
+		bookOf:    make(map[string]string),
+		linkedAt:  make(map[string]place),
+		fixed:     make(set),
+		translate: fromMarkdown,
+		proc:      proc,
+		reader:    fileReader,
+		glob:      filepath.Glob,
 	}
 }
 
 func newDoc() doc {
 	return doc{
-		markdown:    make(map[string]*strings.Builder),
-		chunks:      make(map[string]*chunk),
-		chunkStarts: make(map[string]map[int]string),
-		chunkRefs:   make(map[string]map[int]chunkRef),
-		secStarts:   make(map[string]map[int]section),
-		outNames:    make(map[string]string),
-		writeCloser: getWriteCloser,
+		markdown:     make(map[string]*strings.Builder),
+		chunks:       make(map[string]*chunk),
+		chunkStarts:  make(map[string]map[int]string),
+		chunkRefs:    make(map[string]map[int]chunkRef),
+		secStarts:    make(map[string]map[int]section),
+		setextStarts: make(map[string]map[int]bool),
+		labels:       make(map[string]section),
+		secRefs:      make(map[string]map[int][]string),
+		outNames:     make(map[string]string),
+		bookOf:       make(map[string]string),
+		parts:        make(map[string]map[int]int),
+		generated:    make(map[string]map[int]string),
+		numbering:    "all",
+		numberFrom:   1,
+		anchors:      "numbers",
+		builtinCSS:   true,
+		highlight:    true,
+		lineNumbers:  "none",
+		outLines:     make(map[string]map[int]outLine),
+		stylesheets:  make([]string, 0),
+		slugs:        make(map[string]map[string]string),
+		chunkSlugs:   make(map[string]string),
+		defSlugs:     make(map[string]map[int]string),
+		goIdents:     make(map[string]*goIdent),
+		goPkgs:       make(set),
+		search:       make(map[string][]*searchEntry),
+		searchSec:    make(map[string]*searchEntry),
+		blockIdents:  make(map[string]map[int]*blockIdents),
+		titles:       make(map[string]string),
+		meta:         make(map[string]map[string]string),
+		writeCloser:  getWriteCloser,
+		outReader:    fileReader,
 	}
 }
 
 func (s *state) setInName(name string) *state {
 	s.inName = name
 	s.sec.inName = name
+	s.translate = translatorFor(s.dialect, name)
 	return s
 }
 
@@ -244,6 +1046,7 @@ func (s *state) setFirstInName(name string) *state {
 	s.inName = name
 	s.sec.inName = name
 	s.inNames = []string{name}
+	s.translate = translatorFor(s.dialect, name)
 	return s
 }
 
@@ -252,23 +1055,44 @@ func firstPassForAll(s *state, d *doc) error {
 		inName := s.inNames[i]
 		s.setInName(inName)
 		if i == 0 {
-			base := simpleOutName(filepath.Base(inName))
-			d.outNames[inName] = filepath.Join(d.docOutDir, base)
+			if _, ok := d.outNames[inName]; !ok {
+				base := simpleOutName(filepath.Base(inName))
+				d.outNames[inName] = filepath.Join(d.docOutDir, base)
+			}
+		} else if s.depth(inName) < s.bookDepth {
+			s.book = inName
 		}
-		if err := firstPass(s, d); err != nil {
+		fReader, err := s.reader(inName)
+		if at, ok := s.linkedAt[inName]; err != nil && ok && i > 0 {
+			s.warnings = append(s.warnings,
+				warning{at.fName, at.line,
+					"Can't read " + inName + ": " + err.Error()})
+			s.inNames = append(s.inNames[:i], s.inNames[i+1:]...)
+			delete(d.outNames, inName)
+			i--
+		} else if err != nil {
+			return err
+		} else if err := firstPass(s, d, fReader); err != nil {
 			return err
 		}
 		s.book = ""
 	}
+	d.inNames = s.inNames
+	d.bookOf = s.bookOf
+	d.putOnOnePage()
+	s.checkSecRefs(d)
+	d.makeSlugs()
 	return nil
 }
 
-func firstPass(s *state, d *doc) error {
-	fReader, err := s.reader(s.inName)
-	if err != nil {
+func firstPass(s *state, d *doc, fReader io.ReadCloser) error {
+	s.lineNum = 0
+	s.inFence, s.inFrontMatter = false, false
+	s.block, s.htmlEnd, s.prevLine, s.setext = "", "", "", false
+	if err := processContent(fReader, s, d); err != nil {
+		fReader.Close()
 		return err
 	}
-	processContent(fReader, s, d)
 	if err := fReader.Close(); err != nil {
 		return err
 	}
@@ -290,10 +1114,20 @@ func fileReader(fName string) (io.ReadCloser, error) {
 	return f, err
 }
 
-func processContent(r io.Reader, s *state, d *doc) {
-	sc := bufio.NewScanner(r)
-	for sc.Scan() {
-		s.proc(s, d, sc.Text())
+func processContent(r io.Reader, s *state, d *doc) error {
+	br := bufio.NewReader(r)
+	for first := true; ; first = false {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("%s:%d: Error reading: %s",
+				s.inName, s.lineNum+1, err.Error())
+		}
+		if len(line) > 0 {
+			s.proc(s, d, trimLine(line, first))
+		}
+		if err == io.EOF {
+			break
+		}
 	}
 
 	if s.inChunk {
@@ -301,35 +1135,147 @@ func processContent(r io.Reader, s *state, d *doc) {
 			warning{s.inName, s.lineNum,
 				"Content finished but chunk not closed"})
 	}
+	if s.inFrontMatter {
+		s.warnings = append(s.warnings,
+			warning{s.inName, s.lineNum,
+				"Content finished but front matter not closed"})
+		s.inFrontMatter = false
+	}
+	return nil
+}
+
+// trimLine removes the end of line characters, and any byte order mark
+// if it's the first line.
+func trimLine(line string, first bool) string {
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+	if first {
+		line = strings.TrimPrefix(line, "\uFEFF")
+	}
+	return line
+}
+
+// splitLines splits text into lines without their newlines, with no
+// limit on how long each line can be.
+func splitLines(text string) []string {
+	if text == "" {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
 }
 
 func proc(s *state, d *doc, line string) {
 	s.lineNum++
+	// Read front matter
+	if s.lineNum == 1 && strings.TrimSpace(line) == "---" {
+		s.inFrontMatter = true
+		line = ""
+	} else if s.inFrontMatter {
+		if trimmed := strings.TrimSpace(line); trimmed == "---" || trimmed == "..." {
+			s.inFrontMatter = false
+		} else if key, value, ok := metaField(line); ok {
+			d.addMeta(s.inName, key, value)
+		}
+		line = ""
+	}
+
+	line = s.translate(s, line)
+	parts := strings.Split(line, "\n")
+	for _, part := range parts {
+		procPart(s, d, part)
+	}
+	if len(parts) > 1 {
+		if _, okay := d.parts[s.inName]; !okay {
+			d.parts[s.inName] = make(map[int]int)
+		}
+		d.parts[s.inName][s.lineNum] = len(parts)
+	}
+}
+
+func procPart(s *state, d *doc, line string) {
+	// Track fenced blocks which aren't chunks
+	if !s.inChunk && strings.HasPrefix(line, "~~~") {
+		s.inFence = !s.inFence
+	}
+
+	// Handle directives
+	if !s.inChunk && !s.inFence {
+		if name, arg, ok := directive(line); ok {
+			s.applyDirective(d, name, arg)
+			line = ""
+		}
+	}
+
 	// Track chapter files to read
-	foundInName := markdownLink(line)
-	if s.book != "" && !s.inChunk && foundInName != "" {
-		currDir := filepath.Dir(s.inName)
-		normInName := filepath.Join(currDir, foundInName)
-		s.inNames = append(s.inNames, normInName)
-		// Update map of input to output names
-		d.outNames[normInName] = chapterOutName(d.docOutDir, foundInName)
+	if s.book != "" && !s.inChunk && !s.inFence {
+		for _, foundInName := range markdownLinks(line) {
+			currDir := filepath.Dir(s.inName)
+			normInName := filepath.Join(currDir, foundInName)
+			if s.isAncestor(normInName) {
+				s.warnings = append(s.warnings,
+					warning{s.inName, s.lineNum,
+						"Not following link to " + foundInName + " because it's a cycle"})
+			} else if _, seen := s.linkedAt[normInName]; !seen {
+				s.addChapter(normInName)
+				s.linkedAt[normInName] = place{s.inName, s.lineNum}
+				// Update map of input to output names
+				relInName, err := filepath.Rel(filepath.Dir(s.inNames[0]), normInName)
+				if err != nil {
+					relInName = foundInName
+				}
+				d.outNames[normInName] = chapterOutName(d.docOutDir, relInName)
 
+			}
+		}
 	}
 
 	// Track and mark section changes
 	if s.lineNum == 1 {
 		d.addSectionStart(s.inName, s.lineNum, s.sec)
 	}
-	if !s.inChunk && strings.HasPrefix(line, "#") {
+	if heading, lineNum := s.heading(d, line); heading != "" {
 		var changed bool
-		s.sec, changed = s.sec.next(line)
+		oldLevel := len(s.sec.nums)
+		s.sec, changed = s.sec.next(heading)
 		if changed {
-			d.addSectionStart(s.inName, s.lineNum, s.sec)
+			text, label, unnumbered := headingAttrs(s.sec.text)
+			s.sec.text = text
+			s.numberSection(d, unnumbered)
+			// Record a section's label
+			if label != "" {
+				if _, used := d.labels[label]; used {
+					s.warnings = append(s.warnings,
+						warning{s.inName, lineNum,
+							"Section label #" + label + " is already used"})
+				} else {
+					d.labels[label] = s.sec
+				}
+			}
+
+			d.addSectionStart(s.inName, lineNum, s.sec)
+			s.checkLevel(lineNum, oldLevel, len(s.sec.nums))
+		}
+	}
+	if s.setext {
+		line = ""
+		s.setext = false
+	}
+
+	// Track section references
+	if !s.inChunk && !s.inFence {
+		if labels := secRefLabels(line); len(labels) > 0 {
+			if _, ok := d.secRefs[s.inName]; !ok {
+				d.secRefs[s.inName] = make(map[int][]string)
+			}
+			d.secRefs[s.inName][s.lineNum] = labels
 		}
 	}
 
 	// Collect lines in code chunks
-	inChunkChanged, newChunkName := chunkChanged(&s.inChunk, line)
+	inChunkChanged, newChunkName := false, ""
+	if !s.inFence {
+		inChunkChanged, newChunkName = chunkChanged(&s.inChunk, line)
+	}
 	if !s.inChunk && inChunkChanged {
 		// Capture data for post-chunk references
 		if _, okay := d.chunkRefs[s.inName]; !okay {
@@ -375,53 +1321,324 @@ func proc(s *state, d *doc, line string) {
 	d.markdown[s.inName].WriteString(line + "\n")
 }
 
-func (s *section) toString() string {
-	if len(s.nums) == 0 {
-		return "0"
+// directive returns the name and argument of a directive line, and
+// whether the line was a directive at all.
+func directive(line string) (name string, arg string, ok bool) {
+	re, _ := regexp.Compile("^@([a-z][-_a-z]*)(\\s+(.*))?$")
+	find := re.FindStringSubmatch(line)
+	if find == nil {
+		return "", "", false
 	}
-
-	return s.numsToString() + " " + s.text
+	return find[1], strings.TrimSpace(find[3]), true
 }
 
-func (s *section) numsToString() string {
-	if len(s.nums) == 0 {
-		return "0"
+func (s *state) applyDirective(d *doc, name string, arg string) {
+	if s.fixed[name] &&
+		(name != "book" || s.inName == s.inNames[0] || s.fixed["manifest"]) {
+		return
 	}
 
-	num := ""
-	for i, n := range s.nums {
-		num += strconv.Itoa(n)
-		if i < len(s.nums)-1 {
-			num += "."
+	switch name {
+	case "ignore":
+		// Nothing to do
+	case "book":
+		s.book = s.inName
+	case "book-depth":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			s.warnings = append(s.warnings,
+				warning{s.inName, s.lineNum,
+					"Directive @book-depth needs a number of at least 1"})
+			return
+		}
+		s.bookDepth = n
+	case "title":
+		d.title = arg
+	case "line-dir":
+		d.lineDir = arg
+	case "comment-style":
+		d.commentStyle = arg
+	case "strict":
+		d.strict = true
+	case "search":
+		d.searchable = true
+	case "template":
+		tmpl, err := s.readTemplate(s.relativeDir(arg))
+		if err != nil {
+			s.warnings = append(s.warnings,
+				warning{s.inName, s.lineNum, err.Error()})
+			return
+		}
+		d.template = tmpl
+	case "numbering":
+		if !validNumbering(arg) {
+			s.warnings = append(s.warnings,
+				warning{s.inName, s.lineNum,
+					"Directive @numbering needs all, none or chapters"})
+			return
 		}
+		d.numbering = arg
+	case "number-from":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > 6 {
+			s.warnings = append(s.warnings,
+				warning{s.inName, s.lineNum,
+					"Directive @number-from needs a heading level from 1 to 6"})
+			return
+		}
+		d.numberFrom = n
+	case "appendix":
+		s.startAppendix()
+	case "anchors":
+		if arg != "numbers" && arg != "text" {
+			s.warnings = append(s.warnings,
+				warning{s.inName, s.lineNum,
+					"Directive @anchors needs numbers or text"})
+			return
+		}
+		d.anchors = arg
+	case "line-numbers":
+		if !validLineNumbers(arg) {
+			s.warnings = append(s.warnings,
+				warning{s.inName, s.lineNum,
+					"Directive @line-numbers needs none, source or output"})
+			return
+		}
+		d.lineNumbers = arg
+	case "code-out-dir":
+		d.codeOutDir = s.relativeDir(arg)
+	case "doc-out-dir":
+		d.setDocOutDir(s.relativeDir(arg))
+	case "out-dir":
+		s.applyDirective(d, "code-out-dir", arg)
+		s.applyDirective(d, "doc-out-dir", arg)
+	case "contents", "chunk-index", "ident-index":
+		d.addGenerated(s.inName, s.lineNum, name)
+	default:
+		s.warnings = append(s.warnings,
+			warning{s.inName, s.lineNum, "Unrecognised directive @" + name})
 	}
-	return num
 }
 
-// next returns the section, and if it's changed, given a line of markdown.
-func (s *section) next(line string) (section, bool) {
-	re, _ := regexp.Compile("(#+)\\s+(.*)")
-	find := re.FindStringSubmatch(line)
-	if len(find) < 2 {
-		return *s, false
-	}
+func validNumbering(style string) bool {
+	return style == "all" || style == "none" || style == "chapters"
+}
 
-	oldLevel := len(s.nums)
+func validLineNumbers(style string) bool {
+	return style == "none" || style == "source" || style == "output"
+}
+
+// relativeDir gives a directory relative to the current input file
+func (s *state) relativeDir(dir string) string {
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(filepath.Dir(s.inName), dir)
+}
+
+func (d *doc) setDocOutDir(dir string) {
+	for inName, outName := range d.outNames {
+		if rel, err := filepath.Rel(d.docOutDir, outName); err == nil {
+			d.outNames[inName] = filepath.Join(dir, rel)
+		}
+	}
+	d.docOutDir = dir
+}
+
+// metaField gives the key and value of a line of front matter,
+// and whether the line is a simple field at all.
+func metaField(line string) (key string, value string, ok bool) {
+	re, _ := regexp.Compile(`^([A-Za-z_][-_A-Za-z0-9]*):\s+(.*)$`)
+	find := re.FindStringSubmatch(strings.TrimRight(line, " \t"))
+	if find == nil {
+		return "", "", false
+	}
+	value = find[2]
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') &&
+		value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+	return find[1], value, true
+}
+
+func (d *doc) addMeta(inName string, key string, value string) {
+	if _, ok := d.meta[inName]; !ok {
+		d.meta[inName] = make(map[string]string)
+	}
+	d.meta[inName][key] = value
+}
+
+func (s *section) toString() string {
+	if len(s.nums) == 0 {
+		return "0"
+	}
+	if s.unnumbered {
+		return s.text
+	}
+
+	return s.shownNumber() + " " + s.text
+}
+
+// shownNumber gives the number shown for the section, which is
+// empty if it's unnumbered.
+func (s *section) shownNumber() string {
+	if s.unnumbered {
+		return ""
+	}
+	if s.number != "" {
+		return s.number
+	}
+	return s.numsToString()
+}
+
+func (s *section) numsToString() string {
+	if len(s.nums) == 0 {
+		return "0"
+	}
+
+	num := ""
+	for i, n := range s.nums {
+		num += strconv.Itoa(n)
+		if i < len(s.nums)-1 {
+			num += "."
+		}
+	}
+	return num
+}
+
+// next returns the section, and if it's changed, given a line of markdown.
+func (s *section) next(line string) (section, bool) {
+	re, _ := regexp.Compile("^(#{1,6})\\s+(.*?)(\\s+#+)?\\s*$")
+	find := re.FindStringSubmatch(line)
+	if len(find) < 2 {
+		return *s, false
+	}
+
+	oldLevel := len(s.nums)
 	newLevel := len(find[1])
 	nums := make([]int, newLevel)
+	copy(nums, s.nums)
 	if oldLevel < newLevel {
-		for i := 0; i < oldLevel; i++ {
-			nums[i] = s.nums[i]
+		for i := oldLevel; i < newLevel; i++ {
+			nums[i] = 1
 		}
-		nums[newLevel-1] = 1
 	} else {
-		for i := 0; i < newLevel-1; i++ {
-			nums[i] = s.nums[i]
+		nums[newLevel-1]++
+	}
+
+	return section{inName: s.inName, nums: nums, text: find[2]}, true
+}
+
+// heading gives a line as an ATX heading, if it makes a heading,
+// and the number of the line the heading is on.
+func (s *state) heading(d *doc, line string) (string, int) {
+	prevLine := s.prevLine
+	s.prevLine = line
+
+	switch {
+	case s.inChunk || s.inFence || strings.HasPrefix(line, "```"):
+		s.block = ""
+	case s.htmlEnd != "":
+		if strings.Contains(strings.ToLower(line), s.htmlEnd) {
+			s.htmlEnd = ""
+		}
+	case strings.TrimSpace(line) == "":
+		s.block = ""
+	case atxHeading(line):
+		s.block = ""
+		return line, s.lineNum
+	case s.block == "para" && setextUnderline(line) > 0:
+		s.block = ""
+		s.setext = true
+		d.addSetextStart(s.inName, s.lineNum-1)
+		return strings.Repeat("#", setextUnderline(line)) + " " +
+			strings.TrimSpace(prevLine), s.lineNum - 1
+	case thematicBreak(line):
+		s.block = ""
+	case s.block == "":
+		s.block = "para"
+		if end := htmlBlockEnd(line); end != "" {
+			s.block = ""
+			if !strings.Contains(strings.ToLower(line[1:]), end) {
+				s.htmlEnd = end
+			}
+		} else if otherBlock(line) {
+			s.block = "other"
+		}
+	}
+	return "", 0
+}
+
+// thematicBreak says if a line is a horizontal rule, such as `---`.
+func thematicBreak(line string) bool {
+	re, _ := regexp.Compile("^ {0,3}(-[ \\t]*){3,}$|^ {0,3}(\\*[ \\t]*){3,}$|^ {0,3}(_[ \\t]*){3,}$")
+	return re.MatchString(line)
+}
+
+func atxHeading(line string) bool {
+	re, _ := regexp.Compile("^#{1,6}\\s")
+	return re.MatchString(line)
+}
+
+// setextUnderline gives the level of the heading if the line is
+// a setext underline, or 0 if not.
+func setextUnderline(line string) int {
+	line = strings.TrimRight(line, " \t")
+	switch {
+	case line == "":
+		return 0
+	case strings.Trim(line, "=") == "":
+		return 1
+	case strings.Trim(line, "-") == "":
+		return 2
+	}
+	return 0
+}
+
+// htmlBlockEnd gives what ends the HTML block that a line starts,
+// or an empty string if it doesn't start one.
+func htmlBlockEnd(line string) string {
+	if strings.HasPrefix(line, "<!--") {
+		return "-->"
+	}
+	re, _ := regexp.Compile("^<([A-Za-z][A-Za-z0-9]*)(\\s|/?>|$)")
+	find := re.FindStringSubmatch(line)
+	if find == nil {
+		return ""
+	}
+	tag := strings.ToLower(find[1])
+	for _, t := range htmlBlockTags {
+		if t == tag {
+			return "</" + tag + ">"
 		}
-		nums[newLevel-1] = s.nums[newLevel-1] + 1
 	}
+	return ""
+}
+
+// otherBlock says if a line starts a block which isn't a paragraph
+// and which can't become a heading, such as a list or a quote.
+func otherBlock(line string) bool {
+	re, _ := regexp.Compile("^(    |\t|[-*+]\\s|[0-9]+[.)]\\s|>|\\|)")
+	return re.MatchString(line)
+}
+
+func (d *doc) addSetextStart(inName string, lineNum int) {
+	if _, ok := d.setextStarts[inName]; !ok {
+		d.setextStarts[inName] = make(map[int]bool)
+	}
+	d.setextStarts[inName][lineNum] = true
+}
 
-	return section{s.inName, nums, find[2]}, true
+func (s *state) checkLevel(lineNum int, oldLevel int, newLevel int) {
+	if newLevel <= oldLevel+1 {
+		return
+	}
+	msg := fmt.Sprintf("Heading jumps from level %d to level %d",
+		oldLevel, newLevel)
+	if oldLevel == 0 {
+		msg = fmt.Sprintf("First heading is level %d, not level 1", newLevel)
+	}
+	s.warnings = append(s.warnings, warning{s.inName, lineNum, msg})
 }
 
 func (d *doc) addSectionStart(inName string, lineNum int, sec section) {
@@ -431,22 +1648,472 @@ func (d *doc) addSectionStart(inName string, lineNum int, sec section) {
 	d.secStarts[inName][lineNum] = sec
 }
 
-func markdownLink(line string) string {
-	linkRE := `([^)#]+\.md)`
+// numberSection sets the number shown for the section
+// we've just started.
+func (s *state) numberSection(d *doc, unnumbered bool) {
+	level := len(s.sec.nums) - d.numberFrom + 1
+	if d.numbering == "none" || unnumbered || level < 1 {
+		s.sec.unnumbered = true
+		return
+	}
+	if d.numbering == "chapters" && s.numberedIn != s.inName {
+		s.numberedIn = s.inName
+		s.shown = nil
+		if len(s.inNames) > 0 && s.inName != s.inNames[0] {
+			s.chapter++
+		}
+	}
+
+	shown := make([]int, level)
+	copy(shown, s.shown)
+	if len(s.shown) < level {
+		for i := len(s.shown); i < level; i++ {
+			shown[i] = 1
+		}
+	} else {
+		shown[level-1]++
+	}
+	s.shown = shown
+
+	strs := make([]string, 0)
+	if d.numbering == "chapters" && s.chapter > 0 {
+		strs = append(strs, s.counter(s.chapter))
+	}
+	for i, n := range shown {
+		if i == 0 && d.numbering != "chapters" {
+			strs = append(strs, s.counter(n))
+		} else {
+			strs = append(strs, strconv.Itoa(n))
+		}
+	}
+	if number := strings.Join(strs, "."); number != s.sec.numsToString() {
+		s.sec.number = number
+	}
+}
+
+// counter gives a top level number, which is a letter in an appendix.
+func (s *state) counter(n int) string {
+	if !s.appendix {
+		return strconv.Itoa(n)
+	}
+	str := ""
+	for ; n > 0; n = (n - 1) / 26 {
+		str = string(rune('A'+(n-1)%26)) + str
+	}
+	return str
+}
+
+// startAppendix makes the next top level section or chapter appendix A.
+func (s *state) startAppendix() {
+	s.appendix = true
+	s.shown = nil
+	s.chapter = 0
+}
+
+// headingAttrs gives the text of a heading without its attributes,
+// its label if it has one, and whether it's unnumbered.
+func headingAttrs(text string) (string, string, bool) {
+	re, _ := regexp.Compile(`^(.*?)\s*\{([^{}]*)\}\s*$`)
+	find := re.FindStringSubmatch(text)
+	if find == nil {
+		return text, "", false
+	}
+	attrRE, _ := regexp.Compile(`^(#|\.)[-_A-Za-z0-9]+$`)
+	label := ""
+	unnumbered := false
+	for _, attr := range strings.Fields(find[2]) {
+		switch {
+		case attr == "-" || attr == ".unnumbered":
+			unnumbered = true
+		case !attrRE.MatchString(attr):
+			return text, "", false
+		case attr[0] == '#':
+			label = attr[1:]
+		}
+	}
+	if label == "" && !unnumbered {
+		return text, "", false
+	}
+	return find[1], label, unnumbered
+}
+
+func secRefRegexp() *regexp.Regexp {
+	re, _ := regexp.Compile(
+		`\[([^\[\]]*?)@sec:([-_A-Za-z0-9]+)\]|@sec:([-_A-Za-z0-9]+)`)
+	return re
+}
+
+// secRefLabels gives the labels of all the sections referred to in
+// a line of markdown.
+func secRefLabels(line string) []string {
+	labels := make([]string, 0)
+	outsideCode(line, func(part string) string {
+		for _, find := range secRefRegexp().FindAllStringSubmatch(part, -1) {
+			labels = append(labels, find[2]+find[3])
+		}
+		return part
+	})
+	return labels
+}
+
+// outsideCode changes the parts of a line of markdown which
+// aren't in code spans.
+func outsideCode(line string, change func(string) string) string {
+	parts := strings.Split(line, "`")
+	for i := 0; i < len(parts); i += 2 {
+		parts[i] = change(parts[i])
+	}
+	return strings.Join(parts, "`")
+}
+
+func (s *state) checkSecRefs(d *doc) {
+	for _, inName := range d.inNames {
+		lineNums := make([]int, 0)
+		for lineNum := range d.secRefs[inName] {
+			lineNums = append(lineNums, lineNum)
+		}
+		sort.Ints(lineNums)
+		for _, lineNum := range lineNums {
+			for _, label := range d.secRefs[inName][lineNum] {
+				if _, ok := d.labels[label]; !ok {
+					s.warnings = append(s.warnings,
+						warning{inName, lineNum,
+							"Unknown section label @sec:" + label})
+				}
+			}
+		}
+	}
+}
+
+func translatorFor(dialect string, inName string) translator {
+	if dialect == "" {
+		dialect = dialectExts[filepath.Ext(inName)]
+	}
+	if tr, ok := dialects[dialect]; ok {
+		return tr
+	}
+	return fromMarkdown
+}
+
+func fromMarkdown(s *state, line string) string {
+	return line
+}
+
+func fromLiterate(s *state, line string) string {
+	if s.inChunk {
+		if line == "---" {
+			return "```"
+		}
+		return line
+	}
+
+	switch {
+	case strings.HasPrefix(line, "---") && strings.TrimSpace(line[3:]) != "":
+		name := strings.TrimSpace(line[3:])
+		if strings.HasSuffix(name, "+=") {
+			name = strings.TrimSpace(name[:len(name)-2])
+		} else if strings.HasSuffix(name, ":=") {
+			name = strings.TrimSpace(name[:len(name)-2])
+			s.warnings = append(s.warnings,
+				warning{s.inName, s.lineNum,
+					"Can't redefine chunk " + name + ", so adding to it"})
+		}
+		return "``` " + name
+	case line == "@s" || strings.HasPrefix(line, "@s "):
+		return "# " + strings.TrimSpace(line[2:])
+	case line == "@code_type" || strings.HasPrefix(line, "@code_type "):
+		return "@ignore"
+	case line == "@comment_type" || strings.HasPrefix(line, "@comment_type "):
+		return "@comment-style" + line[len("@comment_type"):]
+	}
+	return line
+}
+
+func fromNoweb(s *state, line string) string {
+	if name := nowebChunkName(line); name != "" {
+		if s.inChunk {
+			return "```\n``` " + name
+		}
+		return "``` " + name
+	}
+	if !s.inChunk {
+		return line
+	}
+
+	if line == "@" || strings.HasPrefix(line, "@ %def ") {
+		return "```"
+	}
+	if strings.HasPrefix(line, "@ ") {
+		return "```\n" + line[2:]
+	}
+	if ref := nowebReferredChunkName(line); ref != "" {
+		return line[0:strings.Index(line, "<<")] + "@{" + ref + "}"
+	}
+	return strings.Replace(line, "@<<", "<<", -1)
+}
+
+// nowebChunkName gives the name of a chunk started by a line,
+// or an empty string if the line doesn't start a chunk.
+func nowebChunkName(line string) string {
+	re, _ := regexp.Compile("^<<(.+)>>=\\s*$")
+	find := re.FindStringSubmatch(line)
+	if find == nil {
+		return ""
+	}
+	return strings.TrimSpace(find[1])
+}
+
+func nowebReferredChunkName(str string) string {
+	str = strings.TrimSpace(str)
+	if strings.HasPrefix(str, "<<") && strings.HasSuffix(str, ">>") {
+		return strings.TrimSpace(str[2 : len(str)-2])
+	}
+	return ""
+}
+
+func fromOrg(s *state, line string) string {
+	keyword := strings.ToLower(strings.TrimSpace(line))
+	if s.inChunk || s.inFence {
+		if keyword == "#+end_src" || keyword == "#+end_example" {
+			if s.inChunk {
+				return "```"
+			}
+			return "~~~"
+		}
+		if s.inChunk {
+			if ref := nowebReferredChunkName(line); ref != "" {
+				return line[0:strings.Index(line, "<<")] + "@{" + ref + "}"
+			}
+		}
+		re, _ := regexp.Compile("^(\\s*),(\\*|#\\+)")
+		return re.ReplaceAllString(line, "$1$2")
+	}
+
+	switch {
+	case strings.HasPrefix(keyword, "#+begin_src"):
+		args := orgHeaderArgs(strings.TrimSpace(line)[len("#+begin_src"):])
+		if name := args[":tangle"]; name != "" && name != "yes" && name != "no" {
+			return "``` " + name
+		}
+		if name := args[":noweb-ref"]; name != "" {
+			return "``` " + name
+		}
+		return "~~~" + args["lang"]
+	case keyword == "#+begin_example":
+		return "~~~"
+	case strings.HasPrefix(keyword, "#+title:"):
+		return "@title " + strings.TrimSpace(strings.TrimSpace(line)[len("#+title:"):])
+	case strings.HasPrefix(keyword, "#+") || line == "#" || strings.HasPrefix(line, "# "):
+		return ""
+	}
+
+	heading, _ := regexp.Compile("^(\\*+)\\s+(.*?)(\\s+:[\\w@#%:]+:)?\\s*$")
+	if find := heading.FindStringSubmatch(line); find != nil {
+		return strings.Repeat("#", len(find[1])) + " " + find[2]
+	}
+
+	return orgToMarkdown(line)
+}
+
+// orgHeaderArgs gives the language (as "lang") and the header arguments
+// (such as ":tangle") in what follows "#+begin_src". As in Org, a value
+// is everything up to the next argument, with any quotes removed.
+func orgHeaderArgs(str string) map[string]string {
+	args := make(map[string]string)
+	key := "lang"
+	for _, field := range strings.Fields(str) {
+		if strings.HasPrefix(field, ":") {
+			key = field
+			args[key] = ""
+		} else if args[key] == "" {
+			args[key] = field
+		} else {
+			args[key] += " " + field
+		}
+	}
+	for key, value := range args {
+		args[key] = strings.Trim(value, `"`)
+	}
+	return args
+}
+
+// orgToMarkdown converts Org markup in a line of text to markdown.
+func orgToMarkdown(line string) string {
+	described, _ := regexp.Compile(`\[\[(?:file:)?([^\]]+)\]\[([^\]]+)\]\]`)
+	line = described.ReplaceAllString(line, "[$2]($1)")
+	plain, _ := regexp.Compile(`\[\[(?:file:)?([^\]]+)\]\]`)
+	line = plain.ReplaceAllString(line, "[$1]($1)")
+	code, _ := regexp.Compile(`(^|[\s(])[=~]([^\s=~]|[^\s=~][^=~]*[^\s=~])[=~]($|[\s.,;:!?)])`)
+	return code.ReplaceAllString(line, "$1`$2`$3")
+}
+
+func (s *state) addChapter(inName string) {
+	idx := 0
+	for i, name := range s.inNames {
+		if name == s.inName {
+			idx = i + 1
+		} else if s.bookOf[name] == s.inName {
+			idx = i + 1
+		}
+	}
+	s.inNames = append(s.inNames, "")
+	copy(s.inNames[idx+1:], s.inNames[idx:])
+	s.inNames[idx] = inName
+	s.bookOf[inName] = s.inName
+}
+
+func (s *state) isAncestor(inName string) bool {
+	for name := s.inName; name != ""; name = s.bookOf[name] {
+		if name == inName {
+			return true
+		}
+	}
+	return false
+}
+
+// depth gives how many books down the chapter is from the top level file.
+func (s *state) depth(inName string) int {
+	depth := 0
+	for name := s.bookOf[inName]; name != ""; name = s.bookOf[name] {
+		depth++
+	}
+	return depth
+}
+
+func markdownLinks(line string) []string {
+	links := make([]string, 0)
+	for _, idx := range markdownLinkIndexes(line) {
+		links = append(links, line[idx[0]:idx[1]])
+	}
+	return links
+}
+
+// markdownLinkIndexes gives the start and end of the filename in each
+// link to an input file in a line of markdown.
+func markdownLinkIndexes(line string) [][]int {
+	exts := []string{"md"}
+	for ext := range dialectExts {
+		exts = append(exts, regexp.QuoteMeta(ext[1:]))
+	}
+	sort.Strings(exts)
+	linkRE := `([^)#]+\.(?:` + strings.Join(exts, "|") + `))`
 	anchorRE := `(#[-A-Za-z0-9_.]*)?`
 	titleRE := `(\s+"[^"]*")?`
 	re, _ := regexp.Compile("\\]\\(" + linkRE + anchorRE + titleRE + "\\)")
-	s := re.FindStringSubmatch(line)
-	if len(s) == 0 {
-		return ""
+	idxs := make([][]int, 0)
+	for _, m := range re.FindAllStringSubmatchIndex(line, -1) {
+		if !isURL(line[m[2]:m[3]]) {
+			idxs = append(idxs, m[2:4])
+		}
 	}
-	return s[1]
+	return idxs
+}
+
+// isURL says if a link is an absolute URL, with a scheme or a host.
+func isURL(link string) bool {
+	re, _ := regexp.Compile("^([A-Za-z][-+.A-Za-z0-9]+:|//)")
+	return re.MatchString(link)
 }
 
 func chapterOutName(docOutDir string, foundInName string) string {
 	return simpleOutName(filepath.Join(docOutDir, foundInName))
 }
 
+// readManifest sets the input files, and maybe their output names
+// and titles, from a manifest file.
+func (s *state) readManifest(d *doc, fName string) error {
+	r, err := s.reader(fName)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	dir := filepath.Dir(fName)
+	inNames := make([]string, 0)
+	sc := bufio.NewScanner(r)
+	lineNum := 0
+	for sc.Scan() {
+		lineNum++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "|")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		if fields[0] == "" || len(fields) > 3 {
+			return fmt.Errorf("%s:%d: Expected input | output | title",
+				fName, lineNum)
+		}
+
+		names := []string{filepath.Join(dir, fields[0])}
+		if isPattern(fields[0]) {
+			if len(fields) > 1 {
+				return fmt.Errorf("%s:%d: Pattern %s can't have an output name or title",
+					fName, lineNum, fields[0])
+			}
+			if names, err = s.glob(names[0]); err != nil {
+				return fmt.Errorf("%s:%d: %s", fName, lineNum, err.Error())
+			}
+			sort.Strings(names)
+			if len(names) == 0 {
+				s.warnings = append(s.warnings,
+					warning{fName, lineNum, "No files match " + fields[0]})
+			}
+		}
+
+		for _, inName := range names {
+			if contains(inNames, inName) {
+				s.warnings = append(s.warnings,
+					warning{fName, lineNum, inName + " is already listed"})
+				continue
+			}
+			inNames = append(inNames, inName)
+			s.linkedAt[inName] = place{fName, lineNum}
+			relInName, err := filepath.Rel(dir, inName)
+			if err != nil {
+				relInName = inName
+			}
+			d.outNames[inName] = chapterOutName(d.docOutDir, relInName)
+			if len(fields) > 1 && fields[1] != "" {
+				d.outNames[inName] = filepath.Join(d.docOutDir, fields[1])
+			}
+			if len(fields) > 2 && fields[2] != "" {
+				d.titles[inName] = fields[2]
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if len(inNames) == 0 {
+		return fmt.Errorf("Manifest %s lists no input files", fName)
+	}
+
+	s.setFirstInName(inNames[0])
+	s.inNames = inNames
+	s.book = ""
+	s.bookDepth = 0
+	s.fixed["book"] = true
+	s.fixed["book-depth"] = true
+	s.fixed["manifest"] = true
+	return nil
+}
+
+func isPattern(fName string) bool {
+	return strings.ContainsAny(fName, "*?[")
+}
+
+func contains(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
 // chunkChanged sees if we're entering or leaving a chunk and updates
 // `inChunk` as needed.
 func chunkChanged(inChunk *bool, line string) (changed bool, newName string) {
@@ -624,7 +2291,7 @@ func (d *doc) writeChunks(
 			return err
 		}
 		bw := bufio.NewWriter(wc)
-		err = d.writeChunk(name, bw, "", fName)
+		err = d.writeChunk(name, bw, "", fName, &outLine{name, 0})
 		if err != nil {
 			wc.Close()
 			return err
@@ -643,13 +2310,25 @@ func (d *doc) writeChunks(
 }
 
 func getWriteCloser(name string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
 	return os.Create(name)
 }
 
 func (d *doc) writeChunk(name string,
 	w *bufio.Writer,
 	indent string,
-	fName string) error {
+	fName string,
+	at *outLine) error {
+
+	if d.commentStyle != "" {
+		comment := strings.Replace(d.commentStyle, "%s", name, -1)
+		if _, err := w.WriteString(indent + comment + "\n"); err != nil {
+			return err
+		}
+		at.line += strings.Count(comment, "\n") + 1
+	}
 
 	chunk := d.chunks[name]
 	for _, cont := range chunk.cont {
@@ -657,12 +2336,14 @@ func (d *doc) writeChunk(name string,
 		var err error
 		if ref := referredChunkName(code); ref != "" {
 			iPos := strings.Index(code, "@")
-			err = d.writeChunk(ref, w, indent+code[0:iPos], fName)
+			err = d.writeChunk(ref, w, indent+code[0:iPos], fName, at)
 		} else {
 			lNum := cont.lNum
 			indentHere := initialWS(code)
 			dir := lineDirective(d.lineDir, indent+indentHere, fName, lNum)
 			_, err = w.WriteString(dir + indent + code + "\n")
+			at.line += strings.Count(dir, "\n") + 1
+			d.recordOutLine(cont.inName, lNum, *at)
 		}
 		if err != nil {
 			return err
@@ -671,6 +2352,20 @@ func (d *doc) writeChunk(name string,
 	return nil
 }
 
+// recordOutLine notes where a code line went, the first time it's written,
+// if we need to know
+func (d *doc) recordOutLine(inName string, lNum int, at outLine) {
+	if d.lineNumbers != "output" {
+		return
+	}
+	if d.outLines[inName] == nil {
+		d.outLines[inName] = make(map[int]outLine)
+	}
+	if _, ok := d.outLines[inName][lNum]; !ok {
+		d.outLines[inName][lNum] = at
+	}
+}
+
 func initialWS(code string) string {
 	whitespace, _ := regexp.Compile("^\\s*")
 	res := whitespace.FindStringSubmatch(code)
@@ -713,150 +2408,1357 @@ func lineDirective(dir string, indent string, fName string, n int) string {
 }
 
 func writeAllMarkdown(inNames []string, d *doc) error {
+	if d.singlePage {
+		return writeSinglePage(inNames, d)
+	}
 	for _, inName := range inNames {
 		if err := writeHTML(inName, d.outNames[inName], d); err != nil {
 			return err
 		}
 	}
-	return nil
+	return nil
+}
+
+func writeHTML(inName string, outName string, d *doc) error {
+	// Get the final markdown
+	md := finalMarkdown(inName, d).String()
+
+	// Render it with a custom renderer (defined later, to link chunk
+	// refs in the code)
+	return writePage(outName, md, d.pageFor(inName, outName),
+		customRenderer(d, inName), d)
+}
+
+// writePage renders markdown as an HTML page, with the given details
+// for its template.
+func writePage(outName string, md string, page pageData,
+	renderer markdown.Renderer, d *doc) error {
+
+	return writeBody(outName, renderMarkdown(md, renderer), page, d)
+}
+
+// renderMarkdown renders markdown as HTML, using a parser
+// with an appropriate extension.
+func renderMarkdown(md string, renderer markdown.Renderer) string {
+	extensions := parser.CommonExtensions | parser.Attributes
+	parser := parser.NewWithExtensions(extensions)
+	return string(markdown.ToHTML([]byte(md), parser, renderer))
+}
+
+// writeBody writes an HTML page with the given body, and the given
+// details for its template.
+func writeBody(outName string, body string, page pageData, d *doc) error {
+	// Fill in the rest of the page
+	page.Body = template.HTML(body)
+	page.Stylesheets = d.stylesheetLinks(outName)
+	if d.builtinCSS && !d.inlineCSS {
+		page.Stylesheet = page.Stylesheets[0]
+	}
+	style, err := d.inlineStyle()
+	if err != nil {
+		return err
+	}
+	page.Style = template.CSS(style)
+	searchBox, searchScripts := d.searchElements(outName)
+	page.SearchBox = template.HTML(searchBox)
+	page.SearchScripts = template.HTML(searchScripts)
+
+	// Write the HTML
+	tmpl := d.template
+	if tmpl == nil {
+		tmpl = defaultTemplate
+	}
+	outFile, err := d.writeCloser(outName)
+	if err != nil {
+		return err
+	}
+	if err := tmpl.Execute(outFile, page); err != nil {
+		outFile.Close()
+		return err
+	}
+	return outFile.Close()
+}
+
+// relLink gives a link from one output file to another.
+func relLink(from string, to string) string {
+	if rel, err := filepath.Rel(filepath.Dir(from), to); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.ToSlash(to)
+}
+
+// titleElement gives the HTML title element, or nothing if there's no title.
+func titleElement(title string) string {
+	if title == "" {
+		return ""
+	}
+	return "<title>" + escapeHTML(title) + "</title>\n    "
+}
+
+// metaElements gives HTML meta elements for those fields of front matter
+// which have a standard meta name.
+func metaElements(meta map[string]string) string {
+	elts := ""
+	for _, name := range []string{"author", "description", "keywords"} {
+		if value, ok := meta[name]; ok {
+			elts += `<meta name="` + name + `" content="` +
+				escapeHTML(value) + "\"/>\n    "
+		}
+	}
+	return elts
+}
+
+func escapeHTML(str string) string {
+	b := bytes.Buffer{}
+	html.EscapeHTML(&b, []byte(str))
+	return b.String()
+}
+
+// Fill in a page's template data
+func (d *doc) pageFor(inName string, outName string) pageData {
+	page := pageData{
+		Title:     d.titleOf(inName),
+		BookTitle: d.title,
+		Head: template.HTML(titleElement(d.titleOf(inName)) +
+			metaElements(d.meta[inName])),
+		Sections: make([]pageSection, 0),
+	}
+
+	for _, sec := range d.headingsOf(inName) {
+		page.Sections = append(page.Sections, pageSection{
+			Number: sec.shownNumber(),
+			Title:  sec.text,
+			Level:  len(sec.nums),
+			Link:   "#" + d.anchorOf(sec),
+		})
+	}
+
+	for i, name := range d.inNames {
+		if name != inName {
+			continue
+		}
+		if i > 0 {
+			page.Prev = d.pageLinkTo(outName, d.inNames[i-1])
+		}
+		if i < len(d.inNames)-1 {
+			page.Next = d.pageLinkTo(outName, d.inNames[i+1])
+		}
+	}
+
+	page.Contents = d.contentsLink(outName)
+	page.Breadcrumb = make([]pageLink, 0)
+	for book := d.bookOf[inName]; book != ""; book = d.bookOf[book] {
+		crumb := d.pageLinkTo(outName, book)
+		page.Breadcrumb = append([]pageLink{*crumb}, page.Breadcrumb...)
+	}
+	if len(page.Sections) > 0 {
+		sec := page.Sections[0]
+		page.Breadcrumb = append(page.Breadcrumb, pageLink{
+			strings.TrimSpace(sec.Number + " " + sec.Title), sec.Link})
+	} else {
+		page.Breadcrumb = append(page.Breadcrumb, *d.pageLinkTo(outName, inName))
+	}
+	return page
+}
+
+// extraPageFor gives the template data for a page of our own.
+func (d *doc) extraPageFor(outName string, title string) pageData {
+	page := pageData{
+		Title:      title,
+		BookTitle:  d.title,
+		Head:       template.HTML(titleElement(title)),
+		Sections:   make([]pageSection, 0),
+		Contents:   d.contentsLink(outName),
+		Breadcrumb: make([]pageLink, 0),
+	}
+	if len(d.inNames) > 0 {
+		page.Breadcrumb = append(page.Breadcrumb,
+			*d.pageLinkTo(outName, d.inNames[0]))
+	}
+	page.Breadcrumb = append(page.Breadcrumb,
+		pageLink{title, filepath.Base(outName)})
+	return page
+}
+
+// contentsLink gives the link from a page to the contents page, or
+// to the first input file if there's no contents page. There's no link
+// from the page to itself, or if there's only one file.
+func (d *doc) contentsLink(outName string) *pageLink {
+	if contents, ok := d.extraPage("contents.html"); ok {
+		if contents == outName {
+			return nil
+		}
+		return &pageLink{"Contents", relLink(outName, contents)}
+	}
+	if len(d.inNames) < 2 || d.outNames[d.inNames[0]] == outName {
+		return nil
+	}
+	return d.pageLinkTo(outName, d.inNames[0])
+}
+
+// headingsOf gives the sections which start with a heading
+// in an input file, in order.
+func (d *doc) headingsOf(inName string) []section {
+	lineNums := make([]int, 0)
+	for lineNum := range d.secStarts[inName] {
+		lineNums = append(lineNums, lineNum)
+	}
+	sort.Ints(lineNums)
+
+	secs := make([]section, 0)
+	for _, lineNum := range lineNums {
+		sec := d.secStarts[inName][lineNum]
+		if len(sec.nums) == 0 || (lineNum == 1 && !d.startsWithHeading(inName)) {
+			continue
+		}
+		secs = append(secs, sec)
+	}
+	return secs
+}
+
+// startsWithHeading says if the first line of an input file is a heading.
+func (d *doc) startsWithHeading(inName string) bool {
+	md, ok := d.markdown[inName]
+	return ok && (strings.HasPrefix(md.String(), "#") || d.setextStarts[inName][1])
+}
+
+// pageLinkTo gives a link to the page of an input file, from an output file.
+// Its title is the file's own title, or else its first heading, or else
+// its name.
+func (d *doc) pageLinkTo(outName string, inName string) *pageLink {
+	title := d.titles[inName]
+	if title == "" {
+		title = d.meta[inName]["title"]
+	}
+	if secs := d.headingsOf(inName); title == "" && len(secs) > 0 {
+		title = secs[0].text
+	}
+	if title == "" {
+		title = filepath.Base(inName)
+	}
+	return &pageLink{title, relLink(outName, d.outNames[inName])}
+}
+
+func (d *doc) titleOf(inName string) string {
+	if title, ok := d.titles[inName]; ok {
+		return title
+	}
+	if title, ok := d.meta[inName]["title"]; ok {
+		return title
+	}
+	return d.title
+}
+
+func finalMarkdown(inName string, d *doc) *strings.Builder {
+	b := strings.Builder{}
+	lineNum := 0
+	inChunk := false
+	d.search[inName] = make([]*searchEntry, 0)
+	delete(d.searchSec, inName)
+	lines := splitLines(d.markdown[inName].String())
+	for i := 0; i < len(lines); i++ {
+		lineNum++
+		mdown := lines[i]
+		// Write all but the last part of a line
+		if n := d.parts[inName][lineNum]; n > 1 {
+			chunkChanged(&inChunk, mdown)
+			b.WriteString(mdown + "\n")
+			// Include post-chunk reference if necessary
+			if ref, ok := d.chunkRefs[inName][lineNum]; ok {
+				str1 := addedToChunkRef(inName, d, ref)
+				str1 = rewriteMarkdownLinks(str1, d, inChunk, inName)
+				b.WriteString(withClass(str1, "chunk-refs"))
+				str2 := usedInChunkRef(inName, d, ref)
+				str2 = rewriteMarkdownLinks(str2, d, inChunk, inName)
+				b.WriteString(withClass(str2, "chunk-refs"))
+				b.WriteString(withClass(identsChunkRef(inName, d, lineNum), "chunk-idents"))
+			}
+
+			for _, part := range lines[i+1 : i+n-1] {
+				chunkChanged(&inChunk, part)
+				b.WriteString(part + "\n")
+			}
+			i += n - 1
+			mdown = lines[i]
+		}
+
+		chunkChanged(&inChunk, mdown)
+		// Add the line to the search index
+		d.addToSearch(inName, lineNum, mdown, inChunk)
+
+		// Rewrite markdown file links
+		mdown = rewriteMarkdownLinks(mdown, d, inChunk, inName)
+
+		// Resolve section references
+		if _, ok := d.secRefs[inName][lineNum]; ok {
+			mdown = d.resolveSecRefs(mdown, d.outNames[inName])
+		}
+
+		// Amend section heading
+		if sec, okay := d.secStarts[inName][lineNum]; okay {
+			if strings.HasPrefix(mdown, "#") || d.setextStarts[inName][lineNum] {
+				mdown = strings.Repeat("#", len(sec.nums)) +
+					" " + d.secAnchors(sec) + sec.toString()
+			} else if lineNum == 1 && !d.singlePage {
+				b.WriteString(d.secAnchors(sec) + "\n")
+			}
+		}
+
+		// Insert chunk name before start of chunk
+		if name, okay := d.chunkStarts[inName][lineNum]; okay {
+			if endsInParagraph(b.String()) {
+				b.WriteString("\n")
+			}
+			anchor, cont := "", ""
+			if i := d.defIndex(name, inName, lineNum); i >= 0 {
+				anchor = d.chunkAnchors(name, i)
+				cont = d.continuations(name, i, inName)
+			}
+			b.WriteString("{.chunk-name}\n" + anchor + name + cont + "\n\n")
+		}
+
+		// Amend chunk starts to include coding language
+		if name, okay := d.chunkStarts[inName][lineNum]; okay {
+			mdown = backticks(mdown)
+			top := topOf(name, d.lat)
+			re, _ := regexp.Compile("[-_a-zA-Z0-9]*$")
+			langs := re.FindStringSubmatch(top)
+			lang := ""
+			if langs != nil {
+				lang = langs[0]
+			}
+			if d.lineNumbers != "none" {
+				lang = "{" + lang + " line=" + strconv.Itoa(lineNum) + "}"
+			}
+			mdown += lang
+		}
+
+		// Insert generated content
+		if kind, ok := d.generated[inName][lineNum]; ok {
+			mdown = d.generate(kind, d.outNames[inName])
+		}
+
+		b.WriteString(mdown + "\n")
+		if d.parts[inName][lineNum] == 0 {
+			// Include post-chunk reference if necessary
+			if ref, ok := d.chunkRefs[inName][lineNum]; ok {
+				str1 := addedToChunkRef(inName, d, ref)
+				str1 = rewriteMarkdownLinks(str1, d, inChunk, inName)
+				b.WriteString(withClass(str1, "chunk-refs"))
+				str2 := usedInChunkRef(inName, d, ref)
+				str2 = rewriteMarkdownLinks(str2, d, inChunk, inName)
+				b.WriteString(withClass(str2, "chunk-refs"))
+				b.WriteString(withClass(identsChunkRef(inName, d, lineNum), "chunk-idents"))
+			}
+
+		}
+	}
+	return &b
+}
+
+// readTemplate reads and parses a page template.
+func (s *state) readTemplate(fName string) (*template.Template, error) {
+	r, err := s.reader(fName)
+	if err != nil {
+		return nil, err
+	}
+	b := strings.Builder{}
+	_, err = io.Copy(&b, r)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+	return template.New(filepath.Base(fName)).Parse(b.String())
+}
+
+// putOnOnePage gives every input file the first one's output file,
+// if we're writing a single page.
+func (d *doc) putOnOnePage() {
+	if !d.singlePage || len(d.inNames) == 0 {
+		return
+	}
+	outName := d.outNames[d.inNames[0]]
+	for _, inName := range d.inNames {
+		d.outNames[inName] = outName
+	}
+}
+
+// writeSinglePage writes all the input files as one HTML page.
+func writeSinglePage(inNames []string, d *doc) error {
+	if len(inNames) == 0 {
+		return nil
+	}
+	outName := d.outNames[inNames[0]]
+
+	body := strings.Builder{}
+	for _, inName := range inNames {
+		md := finalMarkdown(inName, d).String()
+		body.WriteString(aID(d.fileAnchor(inName)) + "\n")
+		body.WriteString(renderMarkdown(md, customRenderer(d, inName)))
+		if !strings.HasSuffix(body.String(), "\n") {
+			body.WriteString("\n")
+		}
+	}
+
+	return writeBody(outName, body.String(), d.singlePageFor(outName), d)
+}
+
+// singlePageFor gives the template data for the single page.
+// It's the first file's page, but with all the sections and no
+// other pages to go to.
+func (d *doc) singlePageFor(outName string) pageData {
+	page := d.pageFor(d.inNames[0], outName)
+	if page.Title == "" {
+		page.Title = d.pageLinkTo(outName, d.inNames[0]).Title
+	}
+	for _, inName := range d.inNames[1:] {
+		for _, sec := range d.headingsOf(inName) {
+			page.Sections = append(page.Sections, pageSection{
+				Number: sec.shownNumber(),
+				Title:  sec.text,
+				Level:  len(sec.nums),
+				Link:   "#" + d.anchorOf(sec),
+			})
+		}
+	}
+	page.Prev, page.Next, page.Contents = nil, nil, nil
+	page.Breadcrumb = page.Breadcrumb[len(page.Breadcrumb)-1:]
+	return page
+}
+
+// fileAnchor gives the anchor for the start of an input file
+// on the single page.
+func (d *doc) fileAnchor(inName string) string {
+	return "file-" + toSafeAlpha(inName)
+}
+
+// addToSearch adds a line of markdown to the search index. It may
+// start a section or a chunk, or be part of one.
+func (d *doc) addToSearch(inName string, lineNum int, line string, inChunk bool) {
+	sec := d.searchSec[inName]
+	if start, ok := d.secStarts[inName][lineNum]; ok && len(start.nums) > 0 {
+		sec = &searchEntry{
+			Kind:   "section",
+			Number: start.shownNumber(),
+			Title:  start.text,
+			Link:   d.searchLink(inName, d.anchorOf(start)),
+		}
+		d.search[inName] = append(d.search[inName], sec)
+		d.searchSec[inName] = sec
+		if strings.HasPrefix(line, "#") || d.setextStarts[inName][lineNum] {
+			return
+		}
+	}
+
+	switch {
+	case sec == nil:
+		// Not in a section
+	case d.chunkStarts[inName][lineNum] != "":
+		name := d.chunkStarts[inName][lineNum]
+		link := sec.Link
+		if i := d.defIndex(name, inName, lineNum); i >= 0 {
+			link = d.searchLink(inName, d.defAnchor(name, i))
+		}
+		d.search[inName] = append(d.search[inName], &searchEntry{
+			Kind:   "chunk",
+			Number: sec.Number,
+			Title:  name,
+			Link:   link,
+		})
+	case inChunk:
+		entries := d.search[inName]
+		entries[len(entries)-1].Text += line + "\n"
+	case strings.TrimSpace(line) != "" && line != "```":
+		sec.Text = strings.TrimSpace(sec.Text + " " + strings.TrimSpace(line))
+	}
+}
+
+// searchLink gives a link to an anchor in an input file's output,
+// relative to the doc out dir.
+func (d *doc) searchLink(inName string, anchor string) string {
+	link := d.outNames[inName]
+	if rel, err := filepath.Rel(d.docOutDir, link); err == nil {
+		link = rel
+	}
+	return filepath.ToSlash(link) + "#" + anchor
+}
+
+// searchElements gives the search box for the top of a page,
+// and the scripts for the bottom, if we're searching.
+func (d *doc) searchElements(outName string) (string, string) {
+	if !d.searchable {
+		return "", ""
+	}
+	base := ""
+	if rel, err := filepath.Rel(filepath.Dir(outName), d.docOutDir); err == nil && rel != "." {
+		base = filepath.ToSlash(rel) + "/"
+	}
+	box := `<form class="search" data-base="` + base + `">
+    <input type="search" placeholder="Search" aria-label="Search"/>
+    <ol class="search-results"></ol>
+    </form>
+    `
+	scripts := `<script src="` + base + `search-index.js"></script>
+    <script src="` + base + `search.js"></script>
+    `
+	return box, scripts
+}
+
+func writeSearchIndex(d *doc) error {
+	if !d.searchable {
+		return nil
+	}
+	entries := make([]*searchEntry, 0)
+	for _, inName := range d.inNames {
+		entries = append(entries, d.search[inName]...)
+	}
+	index, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	files := map[string]string{
+		"search-index.js": "var litgoSearchIndex = " + string(index) + ";\n",
+		"search.js":       searchScript,
+	}
+	for _, base := range []string{"search-index.js", "search.js"} {
+		outFile, err := d.writeCloser(filepath.Join(d.docOutDir, base))
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(outFile, files[base]); err != nil {
+			outFile.Close()
+			return err
+		}
+		if err := outFile.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func rewriteMarkdownLinks(mdown string, d *doc, inChunk bool, inName string) string {
+	if inChunk {
+		return mdown
+	}
+	// Work backwards, so rewriting a link doesn't move the earlier ones
+	idxs := markdownLinkIndexes(mdown)
+	for i := len(idxs) - 1; i >= 0; i-- {
+		start, end := idxs[i][0], idxs[i][1]
+		outLink := rewriteMarkdownLink(mdown[start:end], d, inName)
+		if d.singlePage && strings.HasPrefix(outLink, "#") &&
+			strings.HasPrefix(mdown[end:], "#") {
+			// On a single page the link's own anchor is enough
+			outLink = ""
+		}
+		mdown = mdown[0:start] + outLink + mdown[end:]
+	}
+	return mdown
+}
+
+func rewriteMarkdownLink(foundInName string, d *doc, inName string) string {
+	normFoundInName := filepath.Clean(filepath.Join(filepath.Dir(inName), foundInName))
+	if !isInName(d, normFoundInName) {
+		return foundInName
+	}
+	if d.singlePage {
+		return "#" + d.fileAnchor(normFoundInName)
+	}
+	if rel, ok := d.relOutName(inName, normFoundInName); ok {
+		return rel
+	}
+	return simpleOutName(foundInName)
+}
+
+// relOutName gives the output file of one input file relative to
+// the output file of another, so the first can link to the second.
+func (d *doc) relOutName(hereInName string, inName string) (string, bool) {
+	here, ok1 := d.outNames[hereInName]
+	there, ok2 := d.outNames[inName]
+	if !ok1 || !ok2 {
+		return "", false
+	}
+	rel, err := filepath.Rel(filepath.Dir(here), there)
+	if err != nil {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+func isInName(d *doc, link string) bool {
+	for inName, _ := range d.markdown {
+		if inName == link {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *doc) resolveSecRefs(mdown string, outName string) string {
+	return outsideCode(mdown, func(part string) string {
+		return secRefRegexp().ReplaceAllStringFunc(part, func(ref string) string {
+			find := secRefRegexp().FindStringSubmatch(ref)
+			sec, ok := d.labels[find[2]+find[3]]
+			if !ok {
+				return ref
+			}
+			return "[" + find[1] + sec.toString() + "](" +
+				d.secLink(outName, sec) + ")"
+		})
+	})
+}
+
+func (s *section) anchor() string {
+	return "section-" + s.numsToString()
+}
+
+func aName(name string) string {
+	return "<a name=\"" + name + "\"></a>"
+}
+
+// makeSlugs gives text anchors to all the sections and chunks,
+// if we're using them.
+func (d *doc) makeSlugs() {
+	if d.anchors != "text" {
+		return
+	}
+	taken := make(map[string]string) // What each anchor is taken by
+	if d.singlePage {
+		for _, inName := range d.inNames {
+			d.takeNumberedAnchors(taken, inName)
+		}
+	}
+	for _, inName := range d.inNames {
+		d.slugs[inName] = make(map[string]string)
+		if !d.singlePage {
+			taken = make(map[string]string)
+			d.takeNumberedAnchors(taken, inName)
+		}
+
+		for label, sec := range d.labels {
+			if sec.inName == inName {
+				d.slugs[inName][sec.anchor()] = claim(taken, label, sec.anchor())
+			}
+		}
+
+		for _, lineNum := range d.anchoredLines(inName) {
+			sec, ok := d.secStarts[inName][lineNum]
+			if _, done := d.slugs[inName][sec.anchor()]; ok && !done {
+				d.slugs[inName][sec.anchor()] =
+					claim(taken, slugOf(sec.text, "section"), sec.anchor())
+			}
+			name, ok := d.chunkStarts[inName][lineNum]
+			if !ok {
+				continue
+			}
+			if i := d.defIndex(name, inName, lineNum); i == 0 {
+				d.chunkSlugs[name] =
+					claim(taken, slugOf(name, "chunk"), defOwner(name, i))
+			} else if i > 0 {
+				if d.defSlugs[name] == nil {
+					d.defSlugs[name] = make(map[int]string)
+				}
+				slug := d.chunkSlugs[name] + "-" + strconv.Itoa(i+1)
+				d.defSlugs[name][i] = claim(taken, slug, defOwner(name, i))
+			}
+		}
+	}
+}
+
+// takeNumberedAnchors notes the numbered anchors of an input file
+// as taken.
+func (d *doc) takeNumberedAnchors(taken map[string]string, inName string) {
+	for _, sec := range d.secStarts[inName] {
+		taken[sec.anchor()] = sec.anchor()
+	}
+	for lineNum, name := range d.chunkStarts[inName] {
+		i := d.defIndex(name, inName, lineNum)
+		// Chunks with the same numbered anchor don't own it
+		alias, owner := d.numberedDefAnchor(name, i), defOwner(name, i)
+		if other, ok := taken[alias]; ok && other != owner {
+			owner = alias
+		}
+		taken[alias] = owner
+	}
+}
+
+// defOwner says what owns the anchor of a definition of a chunk.
+func defOwner(name string, i int) string {
+	if i == 0 {
+		return "@{" + name + "}"
+	}
+	return "@{" + name + "}-" + strconv.Itoa(i+1)
+}
+
+// anchoredLines gives the lines of an input file where
+// sections or chunks start, in order.
+func (d *doc) anchoredLines(inName string) []int {
+	lineNums := make([]int, 0)
+	for lineNum := range d.secStarts[inName] {
+		lineNums = append(lineNums, lineNum)
+	}
+	for lineNum := range d.chunkStarts[inName] {
+		if _, ok := d.secStarts[inName][lineNum]; !ok {
+			lineNums = append(lineNums, lineNum)
+		}
+	}
+	sort.Ints(lineNums)
+	return lineNums
+}
+
+// claim takes the first of slug, slug-1, slug-2, etc which isn't
+// taken by anything else, and says it's taken by owner.
+func claim(taken map[string]string, slug string, owner string) string {
+	cand := slug
+	for i := 1; taken[cand] != "" && taken[cand] != owner; i++ {
+		cand = slug + "-" + strconv.Itoa(i)
+	}
+	taken[cand] = owner
+	return cand
+}
+
+// slugOf gives some text as a lower case anchor, with words joined
+// by "-"s and other punctuation removed, or the given alternative
+// if that leaves nothing.
+func slugOf(text string, empty string) string {
+	b := strings.Builder{}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		case unicode.IsSpace(r) || r == '-' || r == '_':
+			b.WriteRune(' ')
+		}
+	}
+	slug := strings.Join(strings.Fields(b.String()), "-")
+	if slug == "" {
+		return empty
+	}
+	return slug
+}
+
+// anchorOf gives the anchor to link to for a section.
+func (d *doc) anchorOf(sec section) string {
+	if slug, ok := d.slugs[sec.inName][sec.anchor()]; ok {
+		return slug
+	}
+	return sec.anchor()
+}
+
+// secAnchors gives the HTML anchors for the start of a section.
+func (d *doc) secAnchors(sec section) string {
+	if slug := d.anchorOf(sec); slug != sec.anchor() {
+		return aID(slug) + aName(sec.anchor())
+	}
+	return aName(sec.anchor())
+}
+
+// chunkAnchors gives the HTML anchors for the start of the
+// i'th definition of a chunk.
+func (d *doc) chunkAnchors(name string, i int) string {
+	numbered := d.numberedDefAnchor(name, i)
+	if slug := d.defAnchor(name, i); slug != numbered {
+		return aID(slug) + aName(numbered)
+	}
+	return aName(numbered)
+}
+
+// defAnchor gives the anchor to link to for the i'th definition
+// of a chunk.
+func (d *doc) defAnchor(name string, i int) string {
+	if i == 0 {
+		if slug, ok := d.chunkSlugs[name]; ok {
+			return slug
+		}
+	} else if slug, ok := d.defSlugs[name][i]; ok {
+		return slug
+	}
+	return d.numberedDefAnchor(name, i)
+}
+
+// numberedDefAnchor gives the numbered anchor of the i'th definition
+// of a chunk. The first is just the chunk's name. The others have an "_",
+// which toSafeAlpha never gives, so they can't be another chunk's.
+func (d *doc) numberedDefAnchor(name string, i int) string {
+	if i == 0 {
+		return toSafeAlpha(name)
+	}
+	return toSafeAlpha(name) + "_" + strconv.Itoa(i+1)
+}
+
+func aID(id string) string {
+	return "<a id=\"" + id + "\"></a>"
+}
+
+func (d *doc) addGenerated(inName string, lineNum int, kind string) {
+	if _, ok := d.generated[inName]; !ok {
+		d.generated[inName] = make(map[int]string)
+	}
+	d.generated[inName][lineNum] = kind
+}
+
+// generate gives the markdown for some generated content, which
+// will appear in the given output file.
+func (d *doc) generate(kind string, outName string) string {
+	switch kind {
+	case "contents":
+		return "\n" + d.tableOfContents(outName)
+	case "chunk-index":
+		return "\n" + d.chunkIndex(outName)
+	case "ident-index":
+		return "\n" + d.identIndex(outName)
+	}
+	return ""
+}
+
+func (d *doc) tableOfContents(outName string) string {
+	toc := ""
+	seen := make(set)
+	depth := -1
+	for _, inName := range d.inNames {
+		for _, sec := range d.sectionsOf(inName) {
+			if len(sec.nums) == 0 || seen[sec.numsToString()] {
+				continue
+			}
+			seen[sec.numsToString()] = true
+			depth++
+			if len(sec.nums)-1 < depth {
+				depth = len(sec.nums) - 1
+			}
+			toc += strings.Repeat("    ", depth) +
+				"* [" + sec.toString() + "](" + d.secLink(outName, sec) + ")\n"
+		}
+	}
+	return toc
+}
+
+// sectionsOf gives the section starts of an input file, in order.
+func (d *doc) sectionsOf(inName string) []section {
+	lineNums := make([]int, 0)
+	for lineNum := range d.secStarts[inName] {
+		lineNums = append(lineNums, lineNum)
+	}
+	sort.Ints(lineNums)
+	secs := make([]section, len(lineNums))
+	for i, lineNum := range lineNums {
+		secs[i] = d.secStarts[inName][lineNum]
+	}
+	return secs
+}
+
+// secLink gives a link to a section, from the given output file.
+func (d *doc) secLink(outName string, sec section) string {
+	if d.singlePage {
+		return "#" + d.anchorOf(sec)
+	}
+	link := simpleOutName(sec.inName)
+	if there, ok := d.outNames[sec.inName]; ok {
+		if rel, err := filepath.Rel(filepath.Dir(outName), there); err == nil {
+			link = filepath.ToSlash(rel)
+		}
+	}
+	return link + "#" + d.anchorOf(sec)
+}
+
+func writeContents(d *doc) error {
+	outName, ok := d.extraPage("contents.html")
+	if !ok {
+		return nil
+	}
+
+	md := "# Contents\n\n" + d.tableOfContents(outName)
+	return writePage(outName, md, d.extraPageFor(outName, "Contents"),
+		customRenderer(d, ""), d)
+}
+
+// extraPage gives the output name of a page of our own, such as the
+// contents, and whether to write it. We only write it if there's more
+// than one input file, not all on a single page, and it wouldn't
+// overwrite one of theirs.
+func (d *doc) extraPage(base string) (string, bool) {
+	outName := filepath.Join(d.docOutDir, base)
+	if len(d.inNames) < 2 || d.singlePage {
+		return outName, false
+	}
+	for _, name := range d.outNames {
+		if name == outName {
+			return outName, false
+		}
+	}
+	return outName, true
+}
+
+// chunkIndex gives the markdown for the chunk index, which will appear
+// in the given output file.
+func (d *doc) chunkIndex(outName string) string {
+	names := make([]string, 0)
+	for name := range d.chunks {
+		names = append(names, name)
+	}
+	sortAlphabetically(names)
+
+	index := ""
+	for _, name := range names {
+		defs := make([]section, 0)
+		for _, def := range d.chunks[name].def {
+			defs = append(defs, def.sec)
+		}
+
+		index += "* `" + name + "`"
+		if len(d.lat.parentsOf[name]) == 0 {
+			index += " (top level)"
+		}
+		index += ": defined in " + d.sectionLinks(outName, defs)
+		if uses := d.usesOf(name); len(uses) > 0 {
+			index += "; used in " + d.sectionLinks(outName, uses)
+		}
+		files := d.outFilesOf(name)
+		for i, file := range files {
+			files[i] = "`" + file + "`"
+		}
+		index += ". Ends up in " + inEnglish(files) + ".\n"
+	}
+	return index
+}
+
+// sortAlphabetically sorts names ignoring case, unless that's
+// all that's different.
+func sortAlphabetically(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		lower1, lower2 := strings.ToLower(names[i]), strings.ToLower(names[j])
+		if lower1 == lower2 {
+			return names[i] < names[j]
+		}
+		return lower1 < lower2
+	})
+}
+
+// sectionLinks gives links to some sections from the given output file,
+// such as "sections 1.1 and 2", with each section only once.
+func (d *doc) sectionLinks(outName string, secs []section) string {
+	links := make([]string, 0)
+	seen := make(set)
+	for _, sec := range secs {
+		link := d.secLink(outName, sec)
+		if seen[link] {
+			continue
+		}
+		seen[link] = true
+		text := sec.shownNumber()
+		if text == "" {
+			text = sec.text
+		}
+		links = append(links, "["+text+"]("+link+")")
+	}
+
+	prefix := "section "
+	if len(links) > 1 {
+		prefix = "sections "
+	}
+	return prefix + inEnglish(links)
+}
+
+// outFilesOf gives the code files a chunk ends up in, in order.
+func (d *doc) outFilesOf(name string) []string {
+	files := make([]string, 0)
+	seen := make(set)
+	names := []string{name}
+	for len(names) > 0 {
+		name, names = names[0], names[1:]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if len(d.lat.parentsOf[name]) == 0 {
+			files = append(files,
+				filepath.ToSlash(filepath.Join(d.codeOutDir, name)))
+		}
+		for par := range d.lat.parentsOf[name] {
+			names = append(names, par)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+func writeChunkIndex(d *doc) error {
+	outName, ok := d.extraPage("chunk-index.html")
+	if !ok || len(d.chunks) == 0 {
+		return nil
+	}
+
+	md := "# Chunk index\n\n" + d.chunkIndex(outName)
+	return writePage(outName, md, d.extraPageFor(outName, "Chunk index"),
+		customRenderer(d, ""), d)
+}
+
+// tangle gives the lines of code of a chunk, as they'd be written
+// out, with the chunk line each one came from.
+func (d *doc) tangle(name string, indent string) []tangledLine {
+	lines := make([]tangledLine, 0)
+	for _, cont := range d.chunks[name].cont {
+		if ref := referredChunkName(cont.code); ref != "" {
+			iPos := strings.Index(cont.code, "@")
+			lines = append(lines, d.tangle(ref, indent+cont.code[0:iPos])...)
+		} else {
+			lines = append(lines, tangledLine{indent + cont.code, name, cont})
+		}
+	}
+	return lines
+}
+
+// indexGoIdents finds the Go identifiers defined and used in those
+// top level chunks which are Go files.
+func (d *doc) indexGoIdents(top []string) {
+	sort.Strings(top)
+	files := make([]goFile, 0)
+	for _, name := range top {
+		if filepath.Ext(name) != ".go" {
+			continue
+		}
+		lines := d.tangle(name, "")
+		code := make([]string, len(lines))
+		for i, line := range lines {
+			code[i] = line.code
+		}
+		fset := token.NewFileSet()
+		f, _ := goparser.ParseFile(fset, name, strings.Join(code, "\n"), 0)
+		if f != nil {
+			files = append(files, goFile{f, fset, lines})
+		}
+	}
+
+	// Find the definitions first, as a use may be in an earlier file
+	defIdents := make(map[*goast.Ident]bool)
+	objs := make(map[*goast.Object]bool)
+	methods := make(map[string][]string) // The keys of methods, by name
+	for _, g := range files {
+		for _, def := range goDefinitions(g.file) {
+			key := goKey(g.file.Name.Name, def.recv, def.id.Name)
+			if def.kind == "method" {
+				methods[def.id.Name] = append(methods[def.id.Name], key)
+			} else if def.id.Obj != nil {
+				objs[def.id.Obj] = true
+			}
+			defIdents[def.id] = true
+			d.addGoIdent(g, def.id, key, def.kind, true)
+		}
+	}
+
+	for _, g := range files {
+		pkg := g.file.Name.Name
+		// Selected names and field names aren't package identifiers
+		fields := make(map[*goast.Ident]bool)
+		goast.Inspect(g.file, func(n goast.Node) bool {
+			switch n := n.(type) {
+			case *goast.SelectorExpr:
+				fields[n.Sel] = true
+				for _, key := range methods[n.Sel.Name] {
+					d.addGoIdent(g, n.Sel, key, "", false)
+				}
+			case *goast.CompositeLit:
+				switch n.Type.(type) {
+				case *goast.MapType, *goast.ArrayType:
+					break
+				default:
+					for _, elt := range n.Elts {
+						if kv, ok := elt.(*goast.KeyValueExpr); ok {
+							if key, ok := kv.Key.(*goast.Ident); ok {
+								fields[key] = true
+							}
+						}
+					}
+				}
+			case *goast.Ident:
+				if n == g.file.Name || fields[n] || defIdents[n] {
+					break
+				}
+				if n.Obj == nil || objs[n.Obj] {
+					d.addGoIdent(g, n, goKey(pkg, "", n.Name), "", false)
+				}
+			}
+			return true
+		})
+	}
+}
+
+// goDefinitions gives the identifiers declared at the package level
+// of a Go file, except for blanks and init functions.
+func goDefinitions(f *goast.File) []goDef {
+	defs := make([]goDef, 0)
+	add := func(id *goast.Ident, kind string, recv string) {
+		if id.Name != "_" && id.Name != "init" {
+			defs = append(defs, goDef{id, kind, recv})
+		}
+	}
+
+	for _, decl := range f.Decls {
+		switch decl := decl.(type) {
+		case *goast.FuncDecl:
+			if decl.Recv != nil {
+				add(decl.Name, "method", recvTypeName(decl.Recv))
+			} else {
+				add(decl.Name, "func", "")
+			}
+		case *goast.GenDecl:
+			for _, spec := range decl.Specs {
+				switch spec := spec.(type) {
+				case *goast.TypeSpec:
+					add(spec.Name, "type", "")
+				case *goast.ValueSpec:
+					for _, name := range spec.Names {
+						add(name, decl.Tok.String(), "")
+					}
+				}
+			}
+		}
+	}
+	return defs
 }
 
-func writeHTML(inName string, outName string, d *doc) error {
-	// Get the final markdown
-	md := finalMarkdown(inName, d).String()
+// recvTypeName gives the name of a method receiver's type,
+// without any pointer.
+func recvTypeName(recv *goast.FieldList) string {
+	if len(recv.List) == 0 {
+		return ""
+	}
+	typ := recv.List[0].Type
+	if star, ok := typ.(*goast.StarExpr); ok {
+		typ = star.X
+	}
+	if id, ok := typ.(*goast.Ident); ok {
+		return id.Name
+	}
+	return ""
+}
 
-	// Render the HTML, using a parser with an appropriate extension
-	// and a custom renderer (defined later, to link chunk refs in the code)
-	extensions := parser.CommonExtensions | parser.Attributes
-	parser := parser.NewWithExtensions(extensions)
-	output := markdown.ToHTML([]byte(md), parser, customRenderer(d, inName))
+// goKey gives the key of a Go identifier in the index, which is the name
+// with its package, and with its receiver's type if it's a method.
+func goKey(pkg string, recv string, name string) string {
+	if recv != "" {
+		return pkg + "." + recv + "." + name
+	}
+	return pkg + "." + name
+}
 
-	// Write the HTML
-	outFile, err := d.writeCloser(outName)
-	if err != nil {
-		return err
+// addGoIdent records a definition or use of a Go identifier.
+// We only record the use of an identifier we've seen defined,
+// and we don't need the kind for a use.
+func (d *doc) addGoIdent(g goFile, id *goast.Ident, key string, kind string, def bool) {
+	if _, ok := d.goIdents[key]; !ok && !def {
+		return
 	}
-	strOutput := `<html><head>
-    <link href="literate-source.css" rel="stylesheet"/>
-    </head>
-    <body>` + string(output) + "</body></html>"
-	_, err = io.WriteString(outFile, strOutput)
-	if err != nil {
-		outFile.Close()
-		return err
+	n := g.fset.Position(id.Pos()).Line
+	if n < 1 || n > len(g.lines) {
+		return
+	}
+	cont := g.lines[n-1].cont
+	end := d.chunkEnd(cont.inName, cont.lNum)
+	ref, ok := d.chunkRefs[cont.inName][end]
+	if !ok {
+		return
 	}
-	return outFile.Close()
-}
 
-func finalMarkdown(inName string, d *doc) *strings.Builder {
-	b := strings.Builder{}
-	r := strings.NewReader(d.markdown[inName].String())
-	sc := bufio.NewScanner(r)
-	lineNum := 0
-	inChunk := false
-	for sc.Scan() {
-		lineNum++
-		mdown := sc.Text()
-		chunkChanged(&inChunk, mdown)
-		// Rewrite markdown file links
-		mdown = rewriteMarkdownLinks(mdown, d, inChunk, inName)
+	if _, ok := d.goIdents[key]; !ok {
+		pkg := g.file.Name.Name
+		d.goIdents[key] = &goIdent{strings.TrimPrefix(key, pkg+"."), pkg, kind, nil, nil}
+		d.goPkgs[pkg] = true
+	}
+	if _, ok := d.blockIdents[cont.inName]; !ok {
+		d.blockIdents[cont.inName] = make(map[int]*blockIdents)
+	}
+	if _, ok := d.blockIdents[cont.inName][end]; !ok {
+		d.blockIdents[cont.inName][end] = &blockIdents{make(set), make(set)}
+	}
 
-		// Amend section heading
-		if sec, okay := d.secStarts[inName][lineNum]; okay {
-			if strings.HasPrefix(mdown, "#") {
-				mdown = strings.Repeat("#", len(sec.nums)) +
-					" " + aName(sec.anchor()) + sec.toString()
-			} else if lineNum == 1 {
-				mdown = aName(sec.anchor()) + "\n" + mdown
-			}
-		}
+	ident, block := d.goIdents[key], d.blockIdents[cont.inName][end]
+	if def {
+		ident.defs = append(ident.defs, ref.thisSec)
+		block.defines[key] = true
+	} else {
+		ident.uses = append(ident.uses, ref.thisSec)
+		block.uses[key] = true
+	}
+}
 
-		// Insert chunk name before start of chunk
-		if name, okay := d.chunkStarts[inName][lineNum]; okay {
-			anchor := ""
-			startInName, startLineNum := d.chunkStart(name)
-			if inName == startInName && lineNum == startLineNum {
-				anchor = aName(toSafeAlpha(name))
-			}
-			b.WriteString("{.chunk-name}\n" + anchor + name + "\n\n")
+// chunkEnd gives the line where the code block with the given line ends,
+// or 0 if there's no such block.
+func (d *doc) chunkEnd(inName string, lineNum int) int {
+	end := 0
+	for refLine := range d.chunkRefs[inName] {
+		if refLine > lineNum && (end == 0 || refLine < end) {
+			end = refLine
 		}
+	}
+	return end
+}
 
-		// Amend chunk starts to include coding language
-		if name, okay := d.chunkStarts[inName][lineNum]; okay {
-			mdown = backticks(mdown)
-			top := topOf(name, d.lat)
-			re, _ := regexp.Compile("[-_a-zA-Z0-9]*$")
-			langs := re.FindStringSubmatch(top)
-			if langs != nil {
-				mdown += langs[0]
-			}
+func identsChunkRef(inName string, d *doc, lineNum int) string {
+	block, ok := d.blockIdents[inName][lineNum]
+	if !ok {
+		return ""
+	}
+
+	defines, _ := d.identNames(block.defines)
+	for i, name := range defines {
+		defines[i] = "`" + name + "`"
+	}
+
+	used := make(set)
+	for key := range block.uses {
+		if !block.defines[key] {
+			used[key] = true
 		}
+	}
+	uses, keys := d.identNames(used)
+	for i, name := range uses {
+		sec := d.goIdents[keys[name]].defs[0]
+		uses[i] = "[`" + name + "`](" + d.secLink(d.outNames[inName], sec) + ")"
+	}
 
-		b.WriteString(mdown + "\n")
-		// Include post-chunk reference if necessary
-		if ref, ok := d.chunkRefs[inName][lineNum]; ok {
-			str1 := addedToChunkRef(inName, d, ref)
-			str1 = rewriteMarkdownLinks(str1, d, inChunk, inName)
-			b.WriteString(str1)
-			str2 := usedInChunkRef(inName, d, ref)
-			str2 = rewriteMarkdownLinks(str2, d, inChunk, inName)
-			b.WriteString(str2)
+	str := ""
+	if len(defines) > 0 {
+		str += "Defines: " + strings.Join(defines, ", ") + "."
+	}
+	if len(uses) > 0 {
+		if str != "" {
+			str += " "
 		}
+		str += "Uses: " + strings.Join(uses, ", ") + "."
+	}
+	if str == "" {
+		return ""
+	}
+	return "\n" + str + "\n\n"
+}
 
+// identNames gives the names we show for some Go identifiers, given by
+// their keys, in alphabetical order, and the key of each name.
+func (d *doc) identNames(idents set) ([]string, map[string]string) {
+	names := make([]string, 0)
+	keys := make(map[string]string)
+	for key := range idents {
+		name := key
+		if len(d.goPkgs) == 1 {
+			name = d.goIdents[key].name
+		}
+		names = append(names, name)
+		keys[name] = key
 	}
-	return &b
+	sortAlphabetically(names)
+	return names, keys
 }
 
-func rewriteMarkdownLinks(mdown string, d *doc, inChunk bool, inName string) string {
-	mdown2 := ""
-	for mdown != mdown2 {
-		mdown2 = mdown
-		mdown = rewriteOneMarkdownLink(mdown2, d, inChunk, inName)
+// identIndex gives the markdown for the identifier index, which will appear
+// in the given output file.
+func (d *doc) identIndex(outName string) string {
+	idents := make(set)
+	for key := range d.goIdents {
+		idents[key] = true
 	}
-	return mdown
+	names, keys := d.identNames(idents)
+
+	index := ""
+	for _, name := range names {
+		ident := d.goIdents[keys[name]]
+		uses := append([]section{}, ident.uses...)
+		sort.SliceStable(uses, func(i, j int) bool { return uses[i].less(uses[j]) })
+
+		index += "* `" + name + "` (" + ident.kind + "): defined in " +
+			d.sectionLinks(outName, ident.defs)
+		if len(uses) > 0 {
+			index += "; used in " + d.sectionLinks(outName, uses)
+		}
+		index += ".\n"
+	}
+	return index
 }
 
-func rewriteOneMarkdownLink(mdown string, d *doc, inChunk bool, inName string) string {
-	foundInName := markdownLink(mdown)
-	normFoundInName := filepath.Clean(filepath.Join(filepath.Dir(inName), foundInName))
-	if !inChunk && foundInName != "" && isInName(d, normFoundInName) {
-		idx := strings.Index(mdown, foundInName)
-		mdown = mdown[0:idx] + simpleOutName(foundInName) + mdown[idx+len(foundInName):]
+func writeIdentIndex(d *doc) error {
+	outName, ok := d.extraPage("ident-index.html")
+	if !ok || len(d.goIdents) == 0 {
+		return nil
 	}
-	return mdown
+
+	md := "# Identifier index\n\n" + d.identIndex(outName)
+	return writePage(outName, md, d.extraPageFor(outName, "Identifier index"),
+		customRenderer(d, ""), d)
 }
 
-func isInName(d *doc, link string) bool {
-	for inName, _ := range d.markdown {
-		if inName == link {
-			return true
+// endsInParagraph says if some markdown ends with paragraph text,
+// which would run into anything written after it.
+func endsInParagraph(md string) bool {
+	md = strings.TrimSuffix(md, "\n")
+	last := md[strings.LastIndex(md, "\n")+1:]
+	return strings.TrimSpace(last) != "" &&
+		!strings.HasPrefix(last, "#") &&
+		!strings.HasPrefix(last, "```") &&
+		!strings.HasPrefix(last, "~~~")
+}
+
+// defIndex gives which definition of a chunk is at the given line,
+// or -1 if none is.
+func (d *doc) defIndex(name string, inName string, lineNum int) int {
+	if chunk, ok := d.chunks[name]; ok {
+		for i, def := range chunk.def {
+			if def.inName == inName && def.line == lineNum {
+				return i
+			}
 		}
 	}
-	return false
+	return -1
 }
 
-func (s *section) anchor() string {
-	return "section-" + s.numsToString()
+// continuations gives the HTML links from the i'th definition of a chunk
+// to the ones before and after it, or an empty string if there are none.
+func (d *doc) continuations(name string, i int, inName string) string {
+	links := make([]string, 0)
+	if i > 0 {
+		links = append(links, "continued from "+d.defLink(name, i-1, inName))
+	}
+	if i < len(d.chunks[name].def)-1 {
+		links = append(links, "continued in "+d.defLink(name, i+1, inName))
+	}
+	if len(links) == 0 {
+		return ""
+	}
+	return ` <span class="chunk-cont">` + strings.Join(links, " / ") + `</span>`
 }
 
-func aName(name string) string {
-	return "<a name=\"" + name + "\"></a>"
+// defLink gives an HTML link to the i'th definition of a chunk, showing
+// its section.
+func (d *doc) defLink(name string, i int, hereInName string) string {
+	def := d.chunks[name].def[i]
+	outName, ok := d.relOutName(hereInName, def.inName)
+	if hereInName == def.inName || d.singlePage || !ok {
+		outName = ""
+	}
+	return `<a href="` + outName + `#` + d.defAnchor(name, i) + `">` +
+		escapeHTML(secMark(def.sec)) + `</a>`
 }
 
-// chunkStart returns the input file and line number of where a chunk starts,
-// or zero values if there is no such chunk.
-func (d *doc) chunkStart(name string) (string, int) {
-	chunks, okay := d.chunks[name]
-	if !okay {
-		return "", 0
+// secMark gives a short way to show a section: its number,
+// or its title if it has no number.
+func secMark(sec section) string {
+	if num := sec.shownNumber(); num != "" {
+		return "§" + num
 	}
+	return sec.text
+}
 
-	def := chunks.def
-	if len(def) == 0 {
-		return "", 0
+// defSites gives the sections where a chunk is defined, in English,
+// with any section mentioned only once.
+func (d *doc) defSites(name string) string {
+	marks := make([]string, 0)
+	seen := make(set)
+	for _, def := range d.chunks[name].def {
+		mark := secMark(def.sec)
+		if !seen[mark] {
+			marks = append(marks, mark)
+			seen[mark] = true
+		}
 	}
-
-	return def[0].inName, def[0].line
+	return inEnglish(marks)
 }
 
 // toSafeAlpha returns the string with all non-alphanumerics turned into "-"s.
@@ -896,6 +3798,15 @@ func backticks(mdown string) string {
 	return out
 }
 
+// withClass gives a paragraph of markdown an HTML class, in place of
+// the blank line it starts with. An empty paragraph stays empty.
+func withClass(md string, class string) string {
+	if md == "" {
+		return ""
+	}
+	return "{." + class + "}" + md
+}
+
 func addedToChunkRef(inName string, d *doc, ref chunkRef) string {
 	chunk := d.chunks[ref.name]
 	secs := make([]section, len(chunk.def))
@@ -914,18 +3825,13 @@ func addedToChunkRef(inName string, d *doc, ref chunkRef) string {
 		return ""
 	}
 
-	return "\nAdded to in " + sectionsAsEnglish(inName, secs) + ".\n\n"
+	return "\nAdded to in " + sectionsAsEnglish(inName, secs, d) + ".\n\n"
 }
 
-func sectionsAsEnglish(inName string, secs []section) string {
-	list := ""
+func sectionsAsEnglish(inName string, secs []section, d *doc) string {
+	links := make([]string, len(secs))
 	for i, sec := range secs {
-		list += sec.markdownLink(inName)
-		if i < len(secs)-2 {
-			list += ", "
-		} else if i == len(secs)-2 {
-			list += " and "
-		}
+		links[i] = sec.markdownLink(inName, d)
 	}
 
 	prefix := "section "
@@ -933,25 +3839,53 @@ func sectionsAsEnglish(inName string, secs []section) string {
 		prefix = "sections "
 	}
 
-	return prefix + list
+	return prefix + inEnglish(links)
+}
+
+// inEnglish gives a list of items as "a, b and c".
+func inEnglish(items []string) string {
+	list := ""
+	for i, item := range items {
+		list += item
+		if i < len(items)-2 {
+			list += ", "
+		} else if i == len(items)-2 {
+			list += " and "
+		}
+	}
+	return list
 }
 
-func (s *section) markdownLink(hereInName string) string {
+func (s *section) markdownLink(hereInName string, d *doc) string {
 	fName, err := filepath.Rel(filepath.Dir(hereInName), s.inName)
 	if err != nil {
 		fName = "!!!" + err.Error() + "!!!"
 	}
-	return "[" + s.numsToString() + "](" + fName + "#" + s.anchor() + ")"
+	text := s.shownNumber()
+	if text == "" {
+		text = s.text
+	}
+	return "[" + text + "](" + fName + "#" + d.anchorOf(*s) + ")"
 }
 
 func usedInChunkRef(inName string, d *doc, ref chunkRef) string {
+	secs := d.usesOf(ref.name)
+	if len(secs) == 0 {
+		return ""
+	}
+
+	return "\nUsed in " + sectionsAsEnglish(inName, secs, d) + ".\n\n"
+}
+
+// usesOf gives the sections where a chunk is used, in order.
+func (d *doc) usesOf(name string) []section {
 	secs := make([]section, 0)
 
 	// Get the sections
-	for parName, _ := range d.lat.parentsOf[ref.name] {
+	for parName, _ := range d.lat.parentsOf[name] {
 		chunk := d.chunks[parName]
 		for _, cont := range chunk.cont {
-			if referredChunkName(cont.code) == ref.name {
+			if referredChunkName(cont.code) == name {
 				var sec section
 				for _, def := range chunk.def {
 					if def.line < cont.lNum {
@@ -963,14 +3897,10 @@ func usedInChunkRef(inName string, d *doc, ref chunkRef) string {
 		}
 	}
 
-	if len(secs) == 0 {
-		return ""
-	}
-
 	// Sort the sections
 	sort.Slice(secs, func(i, j int) bool { return secs[i].less(secs[j]) })
 
-	return "\nUsed in " + sectionsAsEnglish(inName, secs) + ".\n\n"
+	return secs
 }
 
 func (s1 *section) less(s2 section) bool {
@@ -1021,32 +3951,34 @@ func wrappedCodeBlockFixer(
 
 func renderChunk(w io.Writer, cb *ast.CodeBlock, d *doc, inName string) {
 	// Write the block opener
-	preCode := fmt.Sprintf("<pre><code class=\"language-%s\">", cb.Info)
+	lang, start := fenceInfo(string(cb.Info))
+	preCode := fmt.Sprintf("<pre><code class=\"language-%s\">", lang)
 	io.WriteString(w, preCode)
 
-	// Escape the content, but into a string builder
-	b1 := strings.Builder{}
-	html.EscapeHTML(&b1, cb.Leaf.Literal)
-
-	// TODO - Insert links where necessary [continue the code below...]
-
-	b2 := strings.Builder{}
-	sc := bufio.NewScanner(strings.NewReader(b1.String()))
-	for sc.Scan() {
-		codeLine := sc.Text()
+	// Highlight the code, if we can, and escape it.
+	// Lines which refer to chunks become links instead.
+	var sy *syntax
+	if d.highlight {
+		sy = syntaxes[lang]
+	}
+	st := hlState{}
+	b := strings.Builder{}
+	for i, codeLine := range splitLines(string(cb.Leaf.Literal)) {
+		if start > 0 {
+			b.WriteString(d.lineNumber(inName, start+1+i))
+		}
 		if chName := referredChunkName(codeLine); chName != "" {
-			// TODO - If we can get the section of the chunk, we can
-			// use a function a bit like
-			// func (s *section) link(hereInName string)
-			// to create the link.
 			startIndex := strings.Index(codeLine, "@{")
-			prefix := codeLine[0:startIndex]
-			codeLine = prefix + htmlLink(chName, d, inName, "@{"+chName+"}")
+			prefix := escapeHTML(codeLine[0:startIndex])
+			codeLine = prefix + htmlLink(chName, d, inName,
+				escapeHTML("@{"+chName+"}"))
+		} else {
+			codeLine = sy.highlight(codeLine, &st)
 		}
-		b2.WriteString(codeLine + "\n")
+		b.WriteString(codeLine + "\n")
 	}
 
-	io.WriteString(w, b2.String())
+	io.WriteString(w, b.String())
 
 	// Write the block closer
 	io.WriteString(w, "</code></pre>")
@@ -1058,30 +3990,280 @@ func htmlLink(chName string, d *doc, hereInName string, text string) string {
 		return "!!!Cannot link chunk '" + chName + "'!!!"
 	}
 	def := chunk.def[0]
-	outName, ok2 := d.outNames[def.inName]
+	outName, ok2 := d.relOutName(hereInName, def.inName)
 	if !ok2 {
 		return "!!!No output file for input file '" + def.inName + "'!!!"
 	}
-	if hereInName == def.inName {
+	if hereInName == def.inName || d.singlePage {
 		// Don't specify the other file in the anchor if it's this file
 		outName = ""
 	}
-	return `<a href="` + outName + `#` + def.sec.anchor() + `">` + text + `</a>`
+	// Hovering over the link shows all the places it's defined
+	title := ""
+	if len(chunk.def) > 1 {
+		title = ` title="Defined in ` + escapeHTML(d.defSites(chName)) + `"`
+	}
+	return `<a href="` + outName + `#` + d.anchorOf(def.sec) + `"` + title +
+		`>` + text + `</a>`
+}
+
+// fenceInfo gives the language and start line from a code block's
+// info string. The start line is 0 if there isn't one.
+func fenceInfo(info string) (string, int) {
+	i := strings.LastIndex(info, "line=")
+	if i < 0 || (i > 0 && info[i-1] != ' ') {
+		return info, 0
+	}
+	start, err := strconv.Atoi(info[i+len("line="):])
+	if err != nil {
+		return info, 0
+	}
+	return strings.TrimSpace(info[0:i]), start
+}
+
+// lineNumber gives the HTML for the number of a code line,
+// given its line in the input file.
+func (d *doc) lineNumber(inName string, lNum int) string {
+	id, num, title := "L"+strconv.Itoa(lNum), lNum, ""
+	if d.singlePage {
+		id = d.fileAnchor(inName) + "-" + id
+	}
+	if d.lineNumbers == "output" {
+		at, ok := d.outLines[inName][lNum]
+		if !ok {
+			return `<span class="line-number"></span>`
+		}
+		id = toSafeAlpha(at.file) + "-L" + strconv.Itoa(at.line)
+		num = at.line
+		title = ` title="` + escapeHTML(at.file+":"+strconv.Itoa(at.line)) + `"`
+	}
+	return `<a class="line-number" id="` + id + `" href="#` + id + `"` +
+		title + `>` + strconv.Itoa(num) + `</a>`
+}
+
+// setOf makes a set from space-separated words.
+func setOf(words string) set {
+	s := make(set)
+	for _, word := range strings.Fields(words) {
+		s[word] = true
+	}
+	return s
+}
+
+// highlight gives a line of code as HTML, with its tokens marked up.
+// The state says if the line carries on a comment or string from the
+// line before, and is updated for the next line. With no syntax we
+// just escape the line.
+func (sy *syntax) highlight(line string, st *hlState) string {
+	if sy == nil {
+		return escapeHTML(line)
+	}
+
+	b := strings.Builder{}
+	span := func(class string, text string) {
+		b.WriteString(`<span class="` + class + `">` + escapeHTML(text) + `</span>`)
+	}
+
+	i := 0
+
+	// Finish anything carried over from the line before
+	if st.closer != "" {
+		end := sy.closeAt(line, 0, st.closer)
+		if end < 0 {
+			span(st.class, line)
+			return b.String()
+		}
+		span(st.class, line[:end])
+		*st = hlState{}
+		i = end
+	}
+
+	// A whole preprocessor line
+	if sy.meta != "" && i == 0 &&
+		strings.HasPrefix(strings.TrimSpace(line), sy.meta) {
+		span("hl-meta", line)
+		return b.String()
+	}
+
+	// A key at the start of the line
+	if sy.lineKeys && i == 0 {
+		if m := lineKeyRE.FindStringSubmatch(line); m != nil {
+			b.WriteString(escapeHTML(m[1]))
+			span("hl-key", m[2])
+			i = len(m[1]) + len(m[2])
+		}
+	}
+
+	for i < len(line) {
+		rest := line[i:]
+		c := line[i]
+		wordStart := i == 0 || line[i-1] == ' ' || line[i-1] == '\t'
+
+		// Comments
+		if prefix := sy.lineCommentAt(rest); prefix != "" &&
+			(wordStart || !sy.wordComments) {
+			span("hl-comment", rest)
+			break
+		}
+		if open := sy.blockComment[0]; open != "" && strings.HasPrefix(rest, open) {
+			end := sy.closeAt(line, i+len(open), sy.blockComment[1])
+			if end < 0 {
+				span("hl-comment", rest)
+				*st = hlState{sy.blockComment[1], "hl-comment"}
+				break
+			}
+			span("hl-comment", line[i:end])
+			i = end
+			continue
+		}
+
+		// Strings
+		if strings.IndexByte(sy.quotes, c) >= 0 {
+			quote := string(c)
+			end := sy.closeAt(line, i+1, quote)
+			if end < 0 && strings.Contains(sy.multiline, quote) {
+				span("hl-string", rest)
+				*st = hlState{quote, "hl-string"}
+				break
+			}
+			if end >= 0 {
+				class := "hl-string"
+				if sy.keys && strings.HasPrefix(strings.TrimLeft(line[end:], " \t"), ":") {
+					class = "hl-key"
+				}
+				span(class, line[i:end])
+				i = end
+				continue
+			}
+		}
+
+		// Shell variables
+		if sy.variables && c == '$' {
+			if end := variableEnd(line, i); end > i+1 {
+				span("hl-variable", line[i:end])
+				i = end
+				continue
+			}
+		}
+
+		// Numbers, names and anything else
+		if isIdentByte(c) {
+			number := c >= '0' && c <= '9'
+			end := i
+			for end < len(line) &&
+				(isIdentByte(line[end]) || number && line[end] == '.') {
+				end++
+			}
+			word := line[i:end]
+			switch {
+			case number:
+				span("hl-number", word)
+			case sy.isWord(sy.keywords, word):
+				span("hl-keyword", word)
+			case sy.isWord(sy.builtins, word):
+				span("hl-builtin", word)
+			default:
+				b.WriteString(escapeHTML(word))
+			}
+			i = end
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(line[i:])
+		b.WriteString(escapeHTML(line[i : i+size]))
+		i += size
+	}
+
+	return b.String()
+}
+
+// A key at the start of a line, perhaps in a list item,
+// as the indent and the key
+var lineKeyRE = regexp.MustCompile(`^(\s*(?:-\s+)?)([^\s:#'"][^:#]*?)\s*:(?:\s|$)`)
+
+// closeAt gives the index just after something which closes a comment or
+// string, looking from a given index, or -1 if it's not on the line.
+func (sy *syntax) closeAt(line string, from int, closer string) int {
+	escapes := len(closer) == 1 && !strings.Contains(sy.raw, closer)
+	for i := from; i < len(line); i++ {
+		if escapes && line[i] == '\\' {
+			i++
+			continue
+		}
+		if strings.HasPrefix(line[i:], closer) {
+			return i + len(closer)
+		}
+	}
+	return -1
+}
+
+// lineCommentAt gives what starts a line comment at the start of
+// some text, or an empty string if there isn't one.
+func (sy *syntax) lineCommentAt(text string) string {
+	for _, prefix := range sy.lineComments {
+		if strings.HasPrefix(text, prefix) {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// isWord says if a word is in a set of words for this syntax.
+func (sy *syntax) isWord(words set, word string) bool {
+	if sy.caseless {
+		return words[strings.ToLower(word)] || words[word]
+	}
+	return words[word]
+}
+
+// isIdentByte says if a byte can be part of a name or number.
+func isIdentByte(c byte) bool {
+	return c == '_' ||
+		c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// variableEnd gives the index just after a shell variable which starts
+// with the $ at the given index.
+func variableEnd(line string, i int) int {
+	end := i + 1
+	if end >= len(line) {
+		return end
+	}
+	switch c := line[end]; {
+	case c == '{':
+		if close := strings.IndexByte(line[end:], '}'); close >= 0 {
+			return end + close + 1
+		}
+		return end
+	case strings.IndexByte("@*#?$!-0123456789", c) >= 0:
+		return end + 1
+	}
+	for end < len(line) && isIdentByte(line[end]) {
+		end++
+	}
+	return end
 }
 
 func writeStylesheet(d *doc) error {
-	stylesheet := `
-    .chunk-name {
-        background-color: #e0e0ff;
-    }
-`
+	if !d.builtinCSS || d.inlineCSS {
+		return nil
+	}
 
 	fName := filepath.Join(d.docOutDir, "literate-source.css")
+	ours, err := d.isOurStylesheet(fName)
+	if err != nil {
+		return err
+	}
+	if !ours {
+		fmt.Printf("Not writing %s because it has been changed\n", fName)
+		return nil
+	}
+
 	outFile, err := d.writeCloser(fName)
 	if err != nil {
 		return err
 	}
-	_, err = io.WriteString(outFile, stylesheet)
+	_, err = io.WriteString(outFile,
+		stylesheetHeader(builtinStylesheet)+"\n"+builtinStylesheet)
 	if err != nil {
 		outFile.Close()
 		return err
@@ -1089,6 +4271,86 @@ func writeStylesheet(d *doc) error {
 	return outFile.Close()
 }
 
+// stylesheetHeader gives the first line of a stylesheet we write,
+// with a hash of the rest of it so we can tell if it's been changed.
+func stylesheetHeader(css string) string {
+	return fmt.Sprintf(
+		"/* Written by litgo, which won't overwrite it if it's changed: %x */",
+		sha256.Sum256([]byte(css)))
+}
+
+// isOurStylesheet says if we can write our stylesheet to a file, because
+// it's not there yet or it's still exactly as litgo wrote it.
+func (d *doc) isOurStylesheet(fName string) (bool, error) {
+	r, err := d.outReader(fName)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	b := strings.Builder{}
+	_, err = io.Copy(&b, r)
+	r.Close()
+	if err != nil {
+		return false, err
+	}
+	css := b.String()
+
+	for _, old := range oldStylesheets {
+		if css == old {
+			return true, nil
+		}
+	}
+	parts := strings.SplitN(css, "\n", 2)
+	return len(parts) == 2 && parts[0] == stylesheetHeader(parts[1]), nil
+}
+
+// stylesheetLinks gives the links from an output file to the stylesheets
+// for its page, ours first. Stylesheets we're inlining aren't linked.
+func (d *doc) stylesheetLinks(outName string) []string {
+	links := make([]string, 0)
+	if d.builtinCSS && !d.inlineCSS {
+		links = append(links, relLink(outName,
+			filepath.Join(d.docOutDir, "literate-source.css")))
+	}
+	for _, css := range d.stylesheets {
+		if isURL(css) || strings.HasPrefix(css, "/") {
+			links = append(links, css)
+		} else if !d.inlineCSS {
+			links = append(links, relLink(outName,
+				filepath.Join(d.docOutDir, filepath.FromSlash(css))))
+		}
+	}
+	return links
+}
+
+// inlineStyle gives the stylesheets to put into a page, ours first,
+// or nothing if we're not inlining them.
+func (d *doc) inlineStyle() (string, error) {
+	if !d.inlineCSS {
+		return "", nil
+	}
+	b := strings.Builder{}
+	if d.builtinCSS {
+		b.WriteString(builtinStylesheet)
+	}
+	for _, css := range d.stylesheets {
+		if isURL(css) || strings.HasPrefix(css, "/") {
+			continue
+		}
+		r, err := d.outReader(filepath.Join(d.docOutDir, filepath.FromSlash(css)))
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(&b, r)
+		r.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
 func printHelp() {
 	msg := `litgo [--book[=true|false]] [--line-dir <ldir>]
     [-doc-out-dir <dir>] <input-file>
@@ -1098,13 +4360,56 @@ func printHelp() {
     --book[=true|false]
         Says if the input file is a book, in which case links
         to .md files are followed for that file.
+    --book-depth <n>
+        How many levels of files are books, if the input file is.
+        Default is 1.
     --line-dir <ldir>
         <ldir> is the line directive to preceed each code line.
         Use %f for filename, %l for line number,
         %i to include indentation, %% for percent sign.
+    --comment-style <cstyle>
+        <cstyle> is the comment to preceed each chunk in the code.
+        Use %s for the chunk name.
+    --strict[=true|false]
+        If any warning should stop the output being written, and fail
+        the command.
+    --search[=true|false]
+        If a search index should be written, with a search box on
+        each page.
+    --numbering <style>
+        How to number sections: all, none or chapters. Default is all.
+    --number-from <level>
+        The first heading level to number. Default is 1.
+    --anchors <style>
+        How to anchor sections and chunks: numbers, or text to make
+        anchors from their text as well. Default is numbers.
+    --template <template>
+        An HTML template file for the pages, using Go's html/template.
+    --css <css>
+        A stylesheet to add to the pages, relative to the doc out dir,
+        or an absolute URL. It can be given more than once.
+    --builtin-css[=true|false]
+        Says if the pages should use our own stylesheet. Default is true.
+    --highlight[=true|false]
+        Says if code in the pages should be highlighted. Default is true.
+    --line-numbers <style>
+        How to number lines of code in the pages: none, source for
+        the input files' lines, or output for the code files' lines.
+        Default is none.
+    --single-page[=true|false]
+        Says if all the input files should be written as one HTML page.
+    --inline-css[=true|false]
+        Says if the stylesheets should go into the pages themselves.
+    --dialect <dialect>
+        The syntax of the input files: markdown, literate, noweb or org.
+        Default is to decide by file extension.
     --doc-out-dir <dir>
         Output directory for the literate documentation. Default is
         the directory of the input file.
+    --manifest <manifest>
+        A file listing the input files in order, one per line, as
+        input | output | title. Output and title are optional.
+        Use this instead of an input file.
 `
 	fmt.Printf(msg)
 }
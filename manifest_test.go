@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadManifest(t *testing.T) {
+	manifest := "# The book\n" +
+		"index.md | index.html | The book\n" +
+		"\n" +
+		"intro.md | | Introduction\n" +
+		"chapters/*.md\n" +
+		"appendix.md | extra/appendix.html\n" +
+		"intro.md\n" +
+		"missing/*.md\n"
+
+	s := newState()
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		return stringReadCloser{strings.NewReader(manifest)}, nil
+	}
+	s.glob = func(pattern string) ([]string, error) {
+		if pattern == "dir/chapters/*.md" {
+			return []string{"dir/chapters/b.md", "dir/chapters/a.md"}, nil
+		}
+		return nil, nil
+	}
+	d := newDoc()
+	d.docOutDir = "out"
+
+	if err := s.readManifest(&d, "dir/book.txt"); err != nil {
+		t.Fatalf("Error reading manifest: %s", err.Error())
+	}
+
+	expInNames := []string{
+		"dir/index.md",
+		"dir/intro.md",
+		"dir/chapters/a.md",
+		"dir/chapters/b.md",
+		"dir/appendix.md",
+	}
+	if strings.Join(s.inNames, ",") != strings.Join(expInNames, ",") {
+		t.Errorf("Expected input files %q but got %q", expInNames, s.inNames)
+	}
+	if s.inName != "dir/index.md" {
+		t.Errorf("Expected first input file dir/index.md but got %q", s.inName)
+	}
+
+	expOutNames := map[string]string{
+		"dir/index.md":      "out/index.html",
+		"dir/intro.md":      "out/intro.html",
+		"dir/chapters/a.md": "out/chapters/a.html",
+		"dir/chapters/b.md": "out/chapters/b.html",
+		"dir/appendix.md":   "out/extra/appendix.html",
+	}
+	for inName, exp := range expOutNames {
+		if d.outNames[inName] != exp {
+			t.Errorf("Expected out name of %s to be %q but got %q",
+				inName, exp, d.outNames[inName])
+		}
+	}
+
+	expTitles := map[string]string{
+		"dir/index.md": "The book",
+		"dir/intro.md": "Introduction",
+	}
+	if len(d.titles) != len(expTitles) {
+		t.Errorf("Expected titles %#v but got %#v", expTitles, d.titles)
+	}
+	for inName, exp := range expTitles {
+		if d.titles[inName] != exp {
+			t.Errorf("Expected title of %s to be %q but got %q",
+				inName, exp, d.titles[inName])
+		}
+	}
+
+	expWarnings := []struct {
+		line int
+		sub  string
+	}{
+		{7, "already listed"},
+		{8, "missing/*.md"},
+	}
+	if len(s.warnings) != len(expWarnings) {
+		t.Fatalf("Expected %d warnings but got %#v",
+			len(expWarnings), s.warnings)
+	}
+	for i, exp := range expWarnings {
+		w := s.warnings[i]
+		if w.fName != "dir/book.txt" || w.line != exp.line ||
+			!strings.Contains(w.msg, exp.sub) {
+			t.Errorf("Expected warning at line %d about %q but got %#v",
+				exp.line, exp.sub, w)
+		}
+	}
+}
+
+func TestReadManifest_Errors(t *testing.T) {
+	data := []struct {
+		manifest string
+		sub      string
+	}{
+		{"", "no input files"},
+		{"# Just a comment\n", "no input files"},
+		{"book.md\n | out.html\n", "book.txt:2:"},
+		{"book.md | a | b | c\n", "book.txt:1:"},
+		{"book.md\nchaps/*.md | | Chapters\n", "book.txt:2: Pattern"},
+	}
+
+	for _, dt := range data {
+		s := newState()
+		s.reader = func(fName string) (io.ReadCloser, error) {
+			return stringReadCloser{strings.NewReader(dt.manifest)}, nil
+		}
+		d := newDoc()
+
+		err := s.readManifest(&d, "book.txt")
+		if err == nil {
+			t.Errorf("Manifest %q: Expected an error but got none", dt.manifest)
+			continue
+		}
+		if !strings.Contains(err.Error(), dt.sub) {
+			t.Errorf("Manifest %q: Expected error to contain %q but got %q",
+				dt.manifest, dt.sub, err.Error())
+		}
+	}
+}
+
+func TestFirstPassForAll_Manifest(t *testing.T) {
+	data := map[string]string{
+		"book.txt": "index.md | index.html | The book\n" +
+			"chapter.md | chapters/one.html\n",
+		"index.md": "@book\n" +
+			"See the [chapter](chapter.md) and [other](other.md).\n",
+		"chapter.md": "# Chapter\n" +
+			"Back to the [index](index.md).\n",
+		"other.md": "Not a chapter\n",
+	}
+
+	s := newState()
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		content, ok := data[fName]
+		if !ok {
+			return nil, fmt.Errorf("No content found for file %q", fName)
+		}
+		return stringReadCloser{strings.NewReader(content)}, nil
+	}
+	d := newBuilderDoc(newDoc())
+
+	if err := s.readManifest(&d.doc, "book.txt"); err != nil {
+		t.Fatalf("Error reading manifest: %s", err.Error())
+	}
+	if err := firstPassForAll(&s, &d.doc); err != nil {
+		t.Fatalf("Error on first pass for all: %s", err.Error())
+	}
+
+	// Links aren't followed, even with a book directive
+	if len(s.inNames) != 2 {
+		t.Errorf("Expected to read 2 files, but got %q", s.inNames)
+	}
+
+	if err := writeAllMarkdown(s.inNames, &d.doc); err != nil {
+		t.Fatalf("Error on writeAllMarkdown: %s", err.Error())
+	}
+
+	expected := map[string][]string{
+		"index.html": []string{
+			"<title>The book</title>",
+			`<a href="chapters/one.html">chapter</a>`,
+			`<a href="other.md">other</a>`,
+		},
+		"chapters/one.html": []string{
+			`<a href="../index.html">index</a>`,
+		},
+	}
+	for outName, subs := range expected {
+		sb, ok := d.outputs[outName]
+		if !ok {
+			t.Errorf("No output for %s, only for %#v", outName, d.outputs)
+			continue
+		}
+		for _, sub := range subs {
+			if !strings.Contains(sb.String(), sub) {
+				t.Errorf("Output %s did not contain %q. Content is\n%s",
+					outName, sub, sb.String())
+			}
+		}
+	}
+	if strings.Contains(d.outputs["chapters/one.html"].String(), "<title>") {
+		t.Errorf("Expected no title for chapter, but got\n%s",
+			d.outputs["chapters/one.html"].String())
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestProcForNumbering(t *testing.T) {
+	lines := []string{
+		"# Title",
+		"## Preface {-}",
+		"## Intro",
+		"### Detail",
+		"## Body {#body}",
+		"@appendix",
+		"# Extra",
+		"## Extra detail",
+		"# More",
+	}
+	data := []struct {
+		numbering  string
+		numberFrom int
+		exp        []string
+	}{
+		{"all", 1, []string{
+			"1 Title", "Preface", "1.1 Intro", "1.1.1 Detail", "1.2 Body",
+			"A Extra", "A.1 Extra detail", "B More",
+		}},
+		{"none", 1, []string{
+			"Title", "Preface", "Intro", "Detail", "Body",
+			"Extra", "Extra detail", "More",
+		}},
+		{"all", 2, []string{
+			"Title", "Preface", "1 Intro", "1.1 Detail", "2 Body",
+			"Extra", "A Extra detail", "More",
+		}},
+		{"all", 3, []string{
+			"Title", "Preface", "Intro", "1 Detail", "Body",
+			"Extra", "Extra detail", "More",
+		}},
+	}
+
+	for _, dt := range data {
+		s := newState()
+		s.setFirstInName("numbers.md")
+		d := newDoc()
+		d.numbering = dt.numbering
+		d.numberFrom = dt.numberFrom
+
+		act := make([]string, 0)
+		for _, line := range lines {
+			old := s.sec
+			s.proc(&s, &d, line)
+			if s.sec.text != old.text {
+				act = append(act, s.sec.toString())
+			}
+		}
+
+		if strings.Join(act, ", ") != strings.Join(dt.exp, ", ") {
+			t.Errorf("Numbering %s from %d: Expected %q but got %q",
+				dt.numbering, dt.numberFrom, dt.exp, act)
+		}
+	}
+}
+
+func TestProcForNumbering_AnchorsStayUnique(t *testing.T) {
+	s := newState()
+	s.setFirstInName("anchors.md")
+	d := newDoc()
+	d.numbering = "none"
+	lines := []string{"# One", "# Two {-}", "## Two point one", "# Three"}
+
+	for _, line := range lines {
+		s.proc(&s, &d, line)
+	}
+
+	exp := map[int]string{
+		1: "section-1",
+		2: "section-2",
+		3: "section-2.1",
+		4: "section-3",
+	}
+	for lineNum, anchor := range exp {
+		sec := d.secStarts["anchors.md"][lineNum]
+		if sec.anchor() != anchor {
+			t.Errorf("Line %d: Expected anchor %q but got %q",
+				lineNum, anchor, sec.anchor())
+		}
+	}
+}
+
+func TestFirstPassForAll_ChapterNumbering(t *testing.T) {
+	data := map[string]string{
+		"book.md": "# The book\n" +
+			"* [One](one.md)\n" +
+			"* [Two](two.md)\n" +
+			"* [Notes](notes.md)\n" +
+			"* [Index](index.md)\n",
+		"one.md": "# One\n" +
+			"## One point one\n" +
+			"``` Chunk\n" +
+			"one\n" +
+			"```\n",
+		"two.md": "# Two\n" +
+			"# Two again\n" +
+			"## Two again point one\n" +
+			"``` Chunk\n" +
+			"two\n" +
+			"```\n",
+		"notes.md": "@appendix\n" +
+			"# Notes\n",
+		"index.md": "# Index\n",
+	}
+
+	s := newState()
+	s.setFirstInName("book.md")
+	s.book = "book.md"
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		return stringReadCloser{strings.NewReader(data[fName])}, nil
+	}
+	d := newDoc()
+	d.numbering = "chapters"
+
+	if err := firstPassForAll(&s, &d); err != nil {
+		t.Fatalf("Error on first pass for all: %s", err.Error())
+	}
+	d.lat = compileLattice(d.chunks)
+
+	expected := []struct {
+		inName  string
+		lineNum int
+		sec     string
+		anchor  string
+	}{
+		{"book.md", 1, "1 The book", "section-1"},
+		{"one.md", 1, "1.1 One", "section-2"},
+		{"one.md", 2, "1.1.1 One point one", "section-2.1"},
+		{"two.md", 1, "2.1 Two", "section-3"},
+		{"two.md", 2, "2.2 Two again", "section-4"},
+		{"two.md", 3, "2.2.1 Two again point one", "section-4.1"},
+		{"notes.md", 2, "A.1 Notes", "section-5"},
+		{"index.md", 1, "B.1 Index", "section-6"},
+	}
+	for _, exp := range expected {
+		sec, ok := d.secStarts[exp.inName][exp.lineNum]
+		if !ok || sec.toString() != exp.sec || sec.anchor() != exp.anchor {
+			t.Errorf("%s line %d: Expected %q with anchor %q but got %#v",
+				exp.inName, exp.lineNum, exp.sec, exp.anchor, sec)
+		}
+	}
+
+	// References use the numbers shown
+	mdown := finalMarkdown("one.md", &d).String()
+	expRef := "Added to in section [2.2.1](two.html#section-4.1)."
+	if !strings.Contains(mdown, expRef) {
+		t.Errorf("Expected markdown to contain %q but got\n%s", expRef, mdown)
+	}
+}
+
+func TestFinalMarkdown_NoNumbering(t *testing.T) {
+	s := newState()
+	s.setFirstInName("plain.md")
+	d := newDoc()
+	d.numbering = "none"
+	lines := []string{
+		"# Start",
+		"``` Chunk",
+		"one",
+		"```",
+		"# Finish",
+		"``` Chunk",
+		"two",
+		"```",
+	}
+
+	for _, line := range lines {
+		s.proc(&s, &d, line)
+	}
+	d.lat = compileLattice(d.chunks)
+
+	mdown := finalMarkdown("plain.md", &d).String()
+	for _, sub := range []string{
+		"# <a name=\"section-1\"></a>Start\n",
+		"Added to in section [Finish](plain.html#section-2).",
+		"Added to in section [Start](plain.html#section-1).",
+	} {
+		if !strings.Contains(mdown, sub) {
+			t.Errorf("Expected markdown to contain %q but got\n%s", sub, mdown)
+		}
+	}
+}
@@ -129,8 +129,8 @@ func TestProcForChunkDetails(t *testing.T) {
 		"```",
 		"The end",
 	}
-	sec0 := section{s.inName, []int(nil), ""}
-	sec1 := section{s.inName, []int{1}, "Heading"}
+	sec0 := section{inName: s.inName, nums: []int(nil), text: ""}
+	sec1 := section{inName: s.inName, nums: []int{1}, text: "Heading"}
 	expected := map[string]chunk{
 		"First": chunk{
 			[]chunkDef{
@@ -236,8 +236,8 @@ func TestProcForChunkRefs(t *testing.T) {
 		"More chunk content",
 		"```", // Line 13
 	}
-	sec0 := section{s.inName, []int(nil), ""}
-	sec1 := section{s.inName, []int{1}, "First section"}
+	sec0 := section{inName: s.inName, nums: []int(nil), text: ""}
+	sec1 := section{inName: s.inName, nums: []int{1}, text: "First section"}
 	r := strings.NewReader(strings.Join(lines, "\n"))
 	expected := map[int]chunkRef{
 		5:  chunkRef{"Chunk one", sec0},
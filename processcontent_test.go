@@ -1,6 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -39,3 +43,134 @@ func TestProcessContent_CallsProc(t *testing.T) {
 		}
 	}
 }
+
+func TestProcessContent_LongLines(t *testing.T) {
+	long := strings.Repeat("x", 200000)
+	lines := make([]string, 0)
+	s := newState()
+	s.proc = func(s *state, d *doc, in string) { lines = append(lines, in) }
+	d := newDoc()
+
+	err := processContent(strings.NewReader("One\n"+long+"\nThree\n"), &s, &d)
+
+	if err != nil {
+		t.Errorf("Expected no error but got %s", err.Error())
+	}
+	expected := []string{"One", long, "Three"}
+	if len(lines) != len(expected) {
+		t.Fatalf("Should have returned %d lines but got %d", len(expected), len(lines))
+	}
+	for i, exp := range expected {
+		if lines[i] != exp {
+			t.Errorf("line[%d] should be %d chars but was %d chars",
+				i, len(exp), len(lines[i]))
+		}
+	}
+}
+
+func TestProcessContent_LineEndingsAndBOM(t *testing.T) {
+	data := []struct {
+		content string
+		exp     []string
+	}{
+		{"", []string{}},
+		{"\n", []string{""}},
+		{"One\r\nTwo\r\n", []string{"One", "Two"}},
+		{"One\r\n\r\nThree", []string{"One", "", "Three"}},
+		{"\uFEFFOne\nTwo", []string{"One", "Two"}},
+		{"\uFEFF# Title\r\n\uFEFFText\r\n", []string{"# Title", "\uFEFFText"}},
+		{"Carriage\rin the middle\n", []string{"Carriage\rin the middle"}},
+	}
+
+	for _, dt := range data {
+		lines := make([]string, 0)
+		s := newState()
+		s.proc = func(s *state, d *doc, in string) { lines = append(lines, in) }
+		d := newDoc()
+
+		processContent(strings.NewReader(dt.content), &s, &d)
+
+		if !reflect.DeepEqual(lines, dt.exp) {
+			t.Errorf("Content %q: Expected lines %q but got %q",
+				dt.content, dt.exp, lines)
+		}
+	}
+}
+
+// A reader which gives some content and then fails
+type failingReader struct {
+	r io.Reader
+}
+
+func (fr failingReader) Read(p []byte) (int, error) {
+	n, err := fr.r.Read(p)
+	if err == io.EOF {
+		return n, fmt.Errorf("Disk on fire")
+	}
+	return n, err
+}
+
+func TestProcessContent_ReadError(t *testing.T) {
+	s := newState()
+	s.setFirstInName("chapter.md")
+	d := newDoc()
+
+	err := processContent(failingReader{strings.NewReader("One\nTwo\nThr")}, &s, &d)
+
+	if err == nil {
+		t.Fatalf("Expected an error but got none")
+	}
+	if !strings.Contains(err.Error(), "chapter.md:3:") ||
+		!strings.Contains(err.Error(), "Disk on fire") {
+		t.Errorf("Expected error at chapter.md line 3, but got %q", err.Error())
+	}
+}
+
+func TestFirstPassForAll_ReadErrorInChapter(t *testing.T) {
+	data := map[string]string{
+		"book.md":  "* [First chapter](first.md)\n",
+		"first.md": "First line 1\nFirst line 2\n",
+	}
+
+	s := newState()
+	s.setFirstInName("book.md")
+	s.book = "book.md"
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		r := strings.NewReader(data[fName])
+		if fName == "first.md" {
+			return ioutil.NopCloser(failingReader{r}), nil
+		}
+		return stringReadCloser{r}, nil
+	}
+	d := newDoc()
+
+	err := firstPassForAll(&s, &d)
+
+	if err == nil || !strings.Contains(err.Error(), "first.md:3:") {
+		t.Errorf("Expected error reading first.md line 3 but got %v", err)
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	data := []struct {
+		text string
+		exp  []string
+	}{
+		{"", []string{}},
+		{"\n", []string{""}},
+		{"One", []string{"One"}},
+		{"One\n", []string{"One"}},
+		{"One\n\n", []string{"One", ""}},
+		{"One\nTwo", []string{"One", "Two"}},
+		{strings.Repeat("y", 100000) + "\nTwo\n",
+			[]string{strings.Repeat("y", 100000), "Two"}},
+	}
+
+	for _, dt := range data {
+		act := splitLines(dt.text)
+		if !reflect.DeepEqual(act, dt.exp) {
+			t.Errorf("Text %.20q: Expected %d lines but got %d",
+				dt.text, len(dt.exp), len(act))
+		}
+	}
+}
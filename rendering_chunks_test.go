@@ -29,7 +29,7 @@ func Test_RenderChunk_CodeBlockMarkup(t *testing.T) {
 	d.lat = compileLattice(d.chunks)
 
 	expected := []string{
-		`<pre><code class="language-go">import something`,
+		`<pre><code class="language-go"><span class="hl-keyword">import</span> something`,
 		`</code></pre>`,
 	}
 	cb := ast.CodeBlock{
@@ -87,10 +87,10 @@ func Test_RenderChunk_CodeBlockLinksChunkRefs(t *testing.T) {
 	d.lat = compileLattice(d.chunks)
 
 	expected := []string{
-		`10 LET A$='Hiya!'`,
+		`<span class="hl-number">10</span> LET A$=<span class="hl-string">'Hiya!'</span>`,
 		`  <a href="#section-1.2">@{Later bit 1}</a>`,
 		`  <a href="part2.html#section-2">@{Later bit 2}</a>`,
-		`40 END`,
+		`<span class="hl-number">40</span> END`,
 	}
 	cb := ast.CodeBlock{
 		Leaf:     ast.Leaf{Literal: []byte(code)},
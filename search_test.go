@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func searchTestDoc() (state, builderDoc) {
+	s := newState()
+	s.setFirstInName("book.md")
+	d := newBuilderDoc(newDoc())
+	d.docOutDir = "out"
+	d.outNames["book.md"] = "out/ch/book.html"
+	lines := []string{
+		"Before any heading",
+		"# Reading",
+		"Some text about",
+		"",
+		"reading the *input*.",
+		"``` Read",
+		"read()",
+		"```",
+		"Writing",
+		"-------",
+		"More text.",
+		"``` Read",
+		"more()",
+		"```",
+	}
+	for _, line := range lines {
+		s.proc(&s, &d.doc, line)
+	}
+	d.lat = compileLattice(d.chunks)
+	return s, d
+}
+
+func TestFinalMarkdown_SearchIndex(t *testing.T) {
+	_, d := searchTestDoc()
+
+	finalMarkdown("book.md", &d.doc)
+
+	expected := []searchEntry{
+		{"section", "1", "Reading", "Some text about reading the *input*.",
+			"ch/book.html#section-1"},
+		{"chunk", "1", "Read", "read()\n", "ch/book.html#Read"},
+		{"section", "1.1", "Writing", "More text.", "ch/book.html#section-1.1"},
+		{"chunk", "1.1", "Read", "more()\n", "ch/book.html#Read_2"},
+	}
+	act := make([]searchEntry, 0)
+	for _, entry := range d.search["book.md"] {
+		act = append(act, *entry)
+	}
+	if !reflect.DeepEqual(act, expected) {
+		t.Errorf("Expected search entries\n%#v\nbut got\n%#v", expected, act)
+	}
+
+	// Making the markdown again doesn't add the entries again
+	finalMarkdown("book.md", &d.doc)
+	if len(d.search["book.md"]) != len(expected) {
+		t.Errorf("Expected %d entries again but got %d",
+			len(expected), len(d.search["book.md"]))
+	}
+}
+
+func TestFinalMarkdown_SearchIndexTextAnchors(t *testing.T) {
+	_, d := searchTestDoc()
+	d.anchors = "text"
+	d.inNames = []string{"book.md"}
+	d.makeSlugs()
+
+	finalMarkdown("book.md", &d.doc)
+
+	links := make([]string, 0)
+	for _, entry := range d.search["book.md"] {
+		links = append(links, entry.Link)
+	}
+	expected := []string{
+		"ch/book.html#reading",
+		"ch/book.html#read",
+		"ch/book.html#writing",
+		"ch/book.html#read-2",
+	}
+	if !reflect.DeepEqual(links, expected) {
+		t.Errorf("Expected links %q but got %q", expected, links)
+	}
+}
+
+func TestWriteSearchIndex(t *testing.T) {
+	_, d := searchTestDoc()
+	d.inNames = []string{"book.md"}
+	d.searchable = true
+
+	if err := writeAllMarkdown(d.inNames, &d.doc); err != nil {
+		t.Fatalf("Error writing markdown: %s", err.Error())
+	}
+	if err := writeSearchIndex(&d.doc); err != nil {
+		t.Fatalf("Error writing search index: %s", err.Error())
+	}
+
+	index, ok := d.outputs["out/search-index.js"]
+	if !ok {
+		t.Fatalf("Expected search-index.js to be written, but got %#v", d.outputs)
+	}
+	prefix, suffix := "var litgoSearchIndex = ", ";\n"
+	str := index.String()
+	if !strings.HasPrefix(str, prefix) || !strings.HasSuffix(str, suffix) {
+		t.Fatalf("Expected index to be assigned to a variable but got %q", str)
+	}
+	entries := make([]searchEntry, 0)
+	err := json.Unmarshal([]byte(str[len(prefix):len(str)-len(suffix)]), &entries)
+	if err != nil {
+		t.Fatalf("Couldn't read index JSON: %s", err.Error())
+	}
+	if len(entries) != 4 || entries[1].Title != "Read" || entries[1].Text != "read()\n" {
+		t.Errorf("Expected four entries with chunk Read second but got %#v", entries)
+	}
+
+	if _, ok := d.outputs["out/search.js"]; !ok {
+		t.Errorf("Expected search.js to be written, but got %#v", d.outputs)
+	}
+
+	// Pages have the search box, and find the scripts in the doc out dir
+	page := d.outputs["out/ch/book.html"].String()
+	for _, sub := range []string{
+		`<form class="search" data-base="../">`,
+		`<script src="../search-index.js"></script>`,
+		`<script src="../search.js"></script>`,
+	} {
+		if !strings.Contains(page, sub) {
+			t.Errorf("Expected page to contain %q but got\n%s", sub, page)
+		}
+	}
+}
+
+func TestWriteSearchIndex_NotSearchable(t *testing.T) {
+	_, d := searchTestDoc()
+	d.inNames = []string{"book.md"}
+
+	if err := writeAllMarkdown(d.inNames, &d.doc); err != nil {
+		t.Fatalf("Error writing markdown: %s", err.Error())
+	}
+	if err := writeSearchIndex(&d.doc); err != nil {
+		t.Fatalf("Error writing search index: %s", err.Error())
+	}
+
+	if len(d.outputs) != 1 {
+		t.Errorf("Expected only the page to be written but got %#v", d.outputs)
+	}
+	if page := d.outputs["out/ch/book.html"].String(); strings.Contains(page, "search") {
+		t.Errorf("Expected no search box but got\n%s", page)
+	}
+}
+
+func TestProcForSearchDirective(t *testing.T) {
+	s := newState()
+	s.setFirstInName("book.md")
+	d := newDoc()
+
+	s.proc(&s, &d, "@search")
+
+	if !d.searchable {
+		t.Errorf("Expected search directive to make the document searchable")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHeadingAttrs(t *testing.T) {
+	data := []struct {
+		text       string
+		exp        string
+		label      string
+		unnumbered bool
+	}{
+		{"Parsing", "Parsing", "", false},
+		{"Parsing {#parsing}", "Parsing", "parsing", false},
+		{"Parsing   {#the-parser_2}  ", "Parsing", "the-parser_2", false},
+		{"Parsing{#parsing}", "Parsing", "parsing", false},
+		{"{#parsing} Parsing", "{#parsing} Parsing", "", false},
+		{"Parsing {#not a label}", "Parsing {#not a label}", "", false},
+		{"Sets {a, b}", "Sets {a, b}", "", false},
+		{"Preface {-}", "Preface", "", true},
+		{"Preface {.unnumbered}", "Preface", "", true},
+		{"Preface {#preface -}", "Preface", "preface", true},
+		{"Preface {.intro #preface}", "Preface", "preface", false},
+		{"Styled {.intro}", "Styled {.intro}", "", false},
+		{"Empty {}", "Empty {}", "", false},
+	}
+
+	for _, d := range data {
+		text, label, unnumbered := headingAttrs(d.text)
+		if text != d.exp || label != d.label || unnumbered != d.unnumbered {
+			t.Errorf("Text %q: Expected (%q, %q, %t) but got (%q, %q, %t)",
+				d.text, d.exp, d.label, d.unnumbered, text, label, unnumbered)
+		}
+	}
+}
+
+func TestSecRefLabels(t *testing.T) {
+	data := []struct {
+		line   string
+		labels []string
+	}{
+		{"No references", []string{}},
+		{"See @sec:parsing.", []string{"parsing"}},
+		{"[see @sec:parsing] and @sec:output", []string{"parsing", "output"}},
+		{"[@sec:a-b_c]", []string{"a-b_c"}},
+		{"Code `@sec:parsing` isn't a reference", []string{}},
+		{"`code` then @sec:after", []string{"after"}},
+		{"An email@sec:x", []string{"x"}},
+		{"Just @sec: alone", []string{}},
+	}
+
+	for _, d := range data {
+		labels := secRefLabels(d.line)
+		if !reflect.DeepEqual(labels, d.labels) {
+			t.Errorf("Line %q: Expected labels %q but got %q",
+				d.line, d.labels, labels)
+		}
+	}
+}
+
+func TestFirstPassForAll_SectionLabels(t *testing.T) {
+	data := map[string]string{
+		"book.md": "# Introduction {#intro}\n" + // 1
+			"Read [the chapter on @sec:parsing] first.\n" + // 2
+			"Or see @sec:missing.\n" + // 3
+			"* [Parsing](parsing.md)\n", // 4
+		"parsing.md": "## Parsing {#parsing}\n" + // 1
+			"Back to @sec:intro, or `@sec:nowhere`.\n" + // 2
+			"``` Chunk\n" + // 3
+			"// @sec:unknown in code\n" + // 4
+			"```\n" + // 5
+			"## Parsing again {#parsing}\n", // 6
+	}
+
+	s := newState()
+	s.setFirstInName("book.md")
+	s.book = "book.md"
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		return stringReadCloser{strings.NewReader(data[fName])}, nil
+	}
+	d := newDoc()
+	d.docOutDir = "out"
+
+	if err := firstPassForAll(&s, &d); err != nil {
+		t.Fatalf("Error on first pass for all: %s", err.Error())
+	}
+
+	// Labels are taken out of the section titles
+	expLabels := map[string]string{
+		"intro":   "1 Introduction",
+		"parsing": "1.1 Parsing",
+	}
+	if len(d.labels) != len(expLabels) {
+		t.Errorf("Expected labels %#v but got %#v", expLabels, d.labels)
+	}
+	for label, exp := range expLabels {
+		sec := d.labels[label]
+		if sec.toString() != exp {
+			t.Errorf("Expected label %s to be %q but got %q",
+				label, exp, sec.toString())
+		}
+	}
+	if sec := d.secStarts["parsing.md"][6]; sec.toString() != "1.2 Parsing again" {
+		t.Errorf("Expected section 1.2 without its label but got %q", sec.toString())
+	}
+
+	// Duplicate and unknown labels are warned about
+	expWarnings := []warning{
+		{"parsing.md", 6, "Section label #parsing is already used"},
+		{"book.md", 3, "Unknown section label @sec:missing"},
+	}
+	if !reflect.DeepEqual(s.warnings, expWarnings) {
+		t.Errorf("Expected warnings %#v but got %#v", expWarnings, s.warnings)
+	}
+
+	// References are resolved to links in the final markdown
+	expected := map[string][]string{
+		"book.md": []string{
+			"# <a name=\"section-1\"></a>1 Introduction\n",
+			"Read [the chapter on 1.1 Parsing](parsing.html#section-1.1) first.\n",
+			"Or see @sec:missing.\n",
+		},
+		"parsing.md": []string{
+			"## <a name=\"section-1.1\"></a>1.1 Parsing\n",
+			"Back to [1 Introduction](book.html#section-1), or `@sec:nowhere`.\n",
+			"// @sec:unknown in code\n",
+		},
+	}
+	for inName, subs := range expected {
+		mdown := finalMarkdown(inName, &d).String()
+		for _, sub := range subs {
+			if !strings.Contains(mdown, sub) {
+				t.Errorf("Expected markdown for %s to contain %q but got\n%s",
+					inName, sub, mdown)
+			}
+		}
+	}
+}
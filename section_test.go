@@ -1,6 +1,8 @@
 package main
 
 import (
+	"io"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
@@ -18,6 +20,13 @@ func TestSectionNext_SameFile(t *testing.T) {
 		{"", "Aaa", "0", false},
 		{"", "# Title", "1 Title", true},
 		{"", "#  \t  Title", "1 Title", true},
+		{"", "## Title", "1.1 Title", true},
+		{"", "### Title", "1.1.1 Title", true},
+		{"", "#Title", "0", false},
+		{"", "####### Title", "0", false},
+		{"", "# Title #", "1 Title", true},
+		{"", "## Title ##  ", "1.1 Title", true},
+		{"", "# C#", "1 C#", true},
 
 		// When we're at level 1, moving to level 1
 		{"1 One", "", "1 One", false},
@@ -56,9 +65,13 @@ func TestSectionNext_SameFile(t *testing.T) {
 		{"5.9.1 Fine", "# Twext", "6 Twext", true},
 
 		// When we're at level 1, moving to level 3
-		{"1 One", "### Twext", "1.0.1 Twext", true},
-		{"1 One", "###  Twext", "1.0.1 Twext", true},
-		{"2 Two", "### Twext", "2.0.1 Twext", true},
+		{"1 One", "### Twext", "1.1.1 Twext", true},
+		{"1 One", "###  Twext", "1.1.1 Twext", true},
+		{"2 Two", "### Twext", "2.1.1 Twext", true},
+
+		// When we're at level 3, moving to level 6
+		{"2.1.3 Twone", "###### Six", "2.1.3.1.1.1 Six", true},
+		{"2.1.3 Twone", "####### Seven", "2.1.3 Twone", false},
 
 		// When we're at level 2, moving to level 3
 		{"2.1 Twone", "### Thext", "2.1.1 Thext", true},
@@ -91,7 +104,7 @@ func toSection(inName string, line string) section {
 		nums[i], _ = strconv.Atoi(s)
 	}
 
-	return section{inName, nums, line[a+1:]}
+	return section{inName: inName, nums: nums, text: line[a+1:]}
 }
 
 func TestProcForSectionTrackingHeadings(t *testing.T) {
@@ -114,6 +127,10 @@ func TestProcForSectionTrackingHeadings(t *testing.T) {
 		{"```", "2 Next"},
 		{"", "2 Next"},
 		{"## After code", "2.1 After code"},
+		{"~~~sh", "2.1 After code"},
+		{"# Shell comment", "2.1 After code"},
+		{"~~~", "2.1 After code"},
+		{"## After fence", "2.2 After fence"},
 	}
 
 	for i, p := range tData {
@@ -162,15 +179,15 @@ func TestProcForSectionTrackingStartLines(t *testing.T) {
 }
 
 func TestSectionLess(t *testing.T) {
-	s0 := section{"n/a", []int(nil), ""}
-	s1 := section{"n/a", []int{1}, ""}
-	s2 := section{"n/a", []int{2}, ""}
-	s2_4 := section{"n/a", []int{2, 4}, ""}
-	s2_5 := section{"n/a", []int{2, 5}, ""}
-	s3 := section{"n/a", []int{3}, ""}
-	s3_4 := section{"n/a", []int{3, 4}, ""}
-	s3_4_2 := section{"n/a", []int{3, 4, 2}, ""}
-	s3_4_3 := section{"n/a", []int{3, 4, 3}, ""}
+	s0 := section{inName: "n/a", nums: []int(nil), text: ""}
+	s1 := section{inName: "n/a", nums: []int{1}, text: ""}
+	s2 := section{inName: "n/a", nums: []int{2}, text: ""}
+	s2_4 := section{inName: "n/a", nums: []int{2, 4}, text: ""}
+	s2_5 := section{inName: "n/a", nums: []int{2, 5}, text: ""}
+	s3 := section{inName: "n/a", nums: []int{3}, text: ""}
+	s3_4 := section{inName: "n/a", nums: []int{3, 4}, text: ""}
+	s3_4_2 := section{inName: "n/a", nums: []int{3, 4, 2}, text: ""}
+	s3_4_3 := section{inName: "n/a", nums: []int{3, 4, 3}, text: ""}
 	data := []struct {
 		a   section
 		b   section
@@ -213,3 +230,190 @@ func TestSectionLess(t *testing.T) {
 		}
 	}
 }
+
+func TestProcForSectionLevelWarnings(t *testing.T) {
+	s := newState()
+	s.setFirstInName("levels.md")
+	d := newDoc()
+	lines := []string{
+		"## Too deep to start", // 1
+		"# One",                // 2
+		"## One point one",     // 3
+		"#### Skips a level",   // 4
+		"## Back up is fine",   // 5
+		"# Two",                // 6
+		"### Skips again",      // 7
+		"~~~",                  // 8
+		"#### Just code",       // 9
+		"~~~",                  // 10
+	}
+
+	for _, line := range lines {
+		s.proc(&s, &d, line)
+	}
+
+	expected := []struct {
+		line int
+		msg  string
+	}{
+		{1, "First heading is level 2, not level 1"},
+		{4, "Heading jumps from level 2 to level 4"},
+		{7, "Heading jumps from level 1 to level 3"},
+	}
+	if len(s.warnings) != len(expected) {
+		t.Fatalf("Expected %d warnings but got %#v", len(expected), s.warnings)
+	}
+	for i, exp := range expected {
+		w := s.warnings[i]
+		if w.fName != "levels.md" || w.line != exp.line || w.msg != exp.msg {
+			t.Errorf("Expected warning %q at line %d but got %#v",
+				exp.msg, exp.line, w)
+		}
+	}
+	if s.sec.toString() != "3.1.1 Skips again" {
+		t.Errorf("Expected to end in section 3.1.1 but got %q", s.sec.toString())
+	}
+}
+
+func TestProcForSectionTracking_BlockStructure(t *testing.T) {
+	s := newState()
+	s.setFirstInName("blocks.md")
+	d := newDoc()
+	tData := []struct {
+		line  string // Next line
+		exp   string // Expected section as a string
+		start int    // Line where it starts, or 0 if this isn't a new section
+	}{
+		{"Setext title", "0", 0},                    // 1
+		{"============", "1 Setext title", 1},       // 2
+		{"", "1 Setext title", 0},                   // 3
+		{"First line", "1 Setext title", 0},         // 4
+		{"Last line", "1 Setext title", 0},          // 5
+		{"---", "1.1 Last line", 5},                 // 6
+		{"", "1.1 Last line", 0},                    // 7
+		{"---", "1.1 Last line", 0},                 // 8
+		{"Not underlined", "1.1 Last line", 0},      // 9
+		{"", "1.1 Last line", 0},                    // 10
+		{"* A list", "1.1 Last line", 0},            // 11
+		{"---", "1.1 Last line", 0},                 // 12
+		{"", "1.1 Last line", 0},                    // 13
+		{"    Indented code", "1.1 Last line", 0},   // 14
+		{"===", "1.1 Last line", 0},                 // 15
+		{"", "1.1 Last line", 0},                    // 16
+		{"<div class=\"x\">", "1.1 Last line", 0},   // 17
+		{"# In HTML", "1.1 Last line", 0},           // 18
+		{"", "1.1 Last line", 0},                    // 19
+		{"## Still in HTML", "1.1 Last line", 0},    // 20
+		{"</div>", "1.1 Last line", 0},              // 21
+		{"", "1.1 Last line", 0},                    // 22
+		{"<!-- # Comment", "1.1 Last line", 0},      // 23
+		{"# Commented out", "1.1 Last line", 0},     // 24
+		{"-->", "1.1 Last line", 0},                 // 25
+		{"<span>Inline</span>", "1.1 Last line", 0}, // 26
+		{"-----", "1.2 <span>Inline</span>", 26},    // 27
+		{"```", "1.2 <span>Inline</span>", 0},       // 28
+		{"Code", "1.2 <span>Inline</span>", 0},      // 29
+		{"```", "1.2 <span>Inline</span>", 0},       // 30
+		{"---", "1.2 <span>Inline</span>", 0},       // 31
+		{"# Two", "2 Two", 32},                      // 32
+		{"===", "2 Two", 0},                         // 33
+	}
+
+	for i, p := range tData {
+		s.proc(&s, &d, p.line)
+		strSec := s.sec.toString()
+		if strSec != p.exp {
+			t.Errorf("Line %d: Expected sec=%q but got %q",
+				i+1, p.exp, strSec)
+		}
+		if p.start > 0 {
+			if sec, ok := d.secStarts["blocks.md"][p.start]; !ok || sec.toString() != p.exp {
+				t.Errorf("Line %d: Expected section %q to start at line %d but got %#v",
+					i+1, p.exp, p.start, d.secStarts["blocks.md"])
+			}
+		}
+	}
+
+	expSetext := map[int]bool{1: true, 5: true, 26: true}
+	if !reflect.DeepEqual(d.setextStarts["blocks.md"], expSetext) {
+		t.Errorf("Expected setext headings at %#v but got %#v",
+			expSetext, d.setextStarts["blocks.md"])
+	}
+}
+
+func TestFinalMarkdown_SetextHeadings(t *testing.T) {
+	s := newState()
+	s.setFirstInName("setext.md")
+	d := newDoc()
+	lines := []string{
+		"Title",
+		"=====",
+		"Some text",
+		"Subtitle {#sub}",
+		"--------",
+		"More text",
+	}
+	for _, line := range lines {
+		s.proc(&s, &d, line)
+	}
+
+	expected := "# <a name=\"section-1\"></a>1 Title\n" +
+		"\n" +
+		"Some text\n" +
+		"## <a name=\"section-1.1\"></a>1.1 Subtitle\n" +
+		"\n" +
+		"More text\n"
+	act := finalMarkdown("setext.md", &d).String()
+	if act != expected {
+		t.Errorf("Expected markdown %q but got %q", expected, act)
+	}
+	if sec := d.labels["sub"]; sec.toString() != "1.1 Subtitle" {
+		t.Errorf("Expected label for section 1.1 but got %#v", d.labels)
+	}
+}
+
+func TestFirstPassForAll_BlocksEndWithFile(t *testing.T) {
+	data := map[string]string{
+		"book.md": "# Book\n" +
+			"* [C](c.md)\n" +
+			"* [E](e.md)\n" +
+			"<div>\n" +
+			"Never closed\n",
+		"c.md": "# Chapter\n" +
+			"## Sub\n" +
+			"Last text\n",
+		"e.md": "===\n" +
+			"After\n",
+	}
+
+	s := newState()
+	s.setFirstInName("book.md")
+	s.book = "book.md"
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		return stringReadCloser{strings.NewReader(data[fName])}, nil
+	}
+	d := newDoc()
+
+	if err := firstPassForAll(&s, &d); err != nil {
+		t.Fatalf("Error on first pass for all: %s", err.Error())
+	}
+
+	// The unclosed HTML block doesn't hide the next file's headings
+	for lineNum, exp := range map[int]string{1: "2 Chapter", 2: "2.1 Sub"} {
+		if sec, ok := d.secStarts["c.md"][lineNum]; !ok || sec.toString() != exp {
+			t.Errorf("Expected section %s at c.md line %d but got %#v",
+				exp, lineNum, d.secStarts["c.md"])
+		}
+	}
+
+	// The next file's first line doesn't underline the last line of c.md
+	if len(d.setextStarts["c.md"]) != 0 || len(d.secStarts["c.md"]) != 2 {
+		t.Errorf("Expected no setext heading in c.md but got %#v and %#v",
+			d.setextStarts["c.md"], d.secStarts["c.md"])
+	}
+	if sec := d.secStarts["e.md"][1]; len(d.setextStarts["e.md"]) != 0 ||
+		sec.toString() != "2.1 Sub" {
+		t.Errorf("Expected e.md to carry on with section 2.1 but got %#v and %#v",
+			d.setextStarts["e.md"], d.secStarts["e.md"])
+	}
+}
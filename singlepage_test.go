@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func singlePageTestDoc(t *testing.T, anchors string) builderDoc {
+	data := map[string]string{
+		"book.md": "# Book\n" + // 1
+			"@contents\n" + // 2
+			"* [One](ch/one.md)\n" + // 3
+			"* [Two](two.md#section-3)\n" + // 4
+			"``` main.go\n" + // 5
+			"@{Body}\n" + // 6
+			"```\n", // 7
+		"ch/one.md": "Carrying on\n" + // 1
+			"# Intro\n" + // 2
+			"See [two](../two.md).\n" + // 3
+			"``` Body\n" + // 4
+			"func x() {}\n" + // 5
+			"```\n", // 6
+		"two.md": "# Intro\n", // 1
+	}
+
+	s := newState()
+	s.setFirstInName("book.md")
+	s.book = "book.md"
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		return stringReadCloser{strings.NewReader(data[fName])}, nil
+	}
+	d := newBuilderDoc(newDoc())
+	d.docOutDir = "out"
+	d.anchors = anchors
+	d.singlePage = true
+
+	if err := firstPassForAll(&s, &d.doc); err != nil {
+		t.Fatalf("Error on first pass for all: %s", err.Error())
+	}
+	d.lat = compileLattice(d.chunks)
+	return d
+}
+
+func TestWriteSinglePage(t *testing.T) {
+	d := singlePageTestDoc(t, "numbers")
+
+	for _, inName := range d.inNames {
+		if d.outNames[inName] != "out/book.html" {
+			t.Errorf("Expected %s to be written to out/book.html but got %s",
+				inName, d.outNames[inName])
+		}
+	}
+
+	if err := writeAllMarkdown(d.inNames, &d.doc); err != nil {
+		t.Fatalf("Error writing markdown: %s", err.Error())
+	}
+	if err := writeContents(&d.doc); err != nil {
+		t.Fatalf("Error writing contents: %s", err.Error())
+	}
+	if len(d.outputs) != 1 {
+		t.Fatalf("Expected just the one page but got %#v", d.outputs)
+	}
+
+	out := d.outputs["out/book.html"].String()
+	for _, sub := range []string{
+		// Files in order, each with an anchor
+		"<body><a id=\"file-book-md\"></a>\n<h1><a name=\"section-1\"></a>1 Book</h1>",
+		"</code></pre>\n<a id=\"file-ch-one-md\"></a>\n<p>Carrying on</p>",
+		"<a id=\"file-two-md\"></a>\n<h1><a name=\"section-3\"></a>3 Intro</h1>",
+		// Links to files, and anchors in them
+		`<a href="#file-ch-one-md">One</a>`,
+		`<a href="#section-3">Two</a>`,
+		`See <a href="#file-two-md">two</a>.`,
+		// Links to chunks and sections
+		`<a href="#section-2">@{Body}</a>`,
+		`Used in section <a href="#section-1">1</a>.`,
+		`<a href="#section-2">2 Intro</a>`,
+	} {
+		if !strings.Contains(out, sub) {
+			t.Errorf("Expected page to contain %q but got\n%s", sub, out)
+		}
+	}
+	if strings.Count(out, `<a name="section-1">`) != 1 {
+		t.Errorf("Expected the section 1 anchor just once but got\n%s", out)
+	}
+	if strings.Contains(out, "<nav") {
+		t.Errorf("Expected no navigation but got\n%s", out)
+	}
+}
+
+func TestSinglePageFor(t *testing.T) {
+	d := singlePageTestDoc(t, "numbers")
+
+	page := d.singlePageFor("out/book.html")
+
+	if page.Title != "Book" {
+		t.Errorf("Expected title Book but got %q", page.Title)
+	}
+	titles := make([]string, 0)
+	for _, sec := range page.Sections {
+		titles = append(titles, sec.Number+" "+sec.Title)
+	}
+	if strings.Join(titles, ", ") != "1 Book, 2 Intro, 3 Intro" {
+		t.Errorf("Expected all the sections but got %q", titles)
+	}
+	if page.Prev != nil || page.Next != nil || page.Contents != nil ||
+		len(page.Breadcrumb) != 1 {
+		t.Errorf("Expected nowhere else to go but got %#v", page)
+	}
+}
+
+func TestMakeSlugs_SinglePage(t *testing.T) {
+	d := singlePageTestDoc(t, "text")
+
+	if d.slugs["ch/one.md"]["section-2"] != "intro" ||
+		d.slugs["two.md"]["section-3"] != "intro-1" {
+		t.Errorf("Expected slugs unique across files but got %#v", d.slugs)
+	}
+}
+
+func TestWriteHTML_InlineCSS(t *testing.T) {
+	d := newBuilderDoc(newDoc())
+	d.docOutDir = "out"
+	d.outNames["book.md"] = "out/book.html"
+	d.markdown["book.md"] = &strings.Builder{}
+	d.markdown["book.md"].WriteString("Hello\n")
+	d.inlineCSS = true
+	d.stylesheets = []string{"theme.css", "https://example.com/fonts.css"}
+	d.outReader = func(name string) (io.ReadCloser, error) {
+		if name != "out/theme.css" {
+			t.Errorf("Expected to read out/theme.css but read %s", name)
+		}
+		return stringReadCloser{strings.NewReader("p { color: red; }\n")}, nil
+	}
+
+	if err := writeHTML("book.md", "out/book.html", &d.doc); err != nil {
+		t.Fatalf("Error writing HTML: %s", err.Error())
+	}
+
+	out := d.outputs["out/book.html"].String()
+	expected := "<link href=\"https://example.com/fonts.css\" rel=\"stylesheet\"/>\n" +
+		"    <style>" + builtinStylesheet + "p { color: red; }\n</style>\n" +
+		"    </head>"
+	if !strings.Contains(out, expected) {
+		t.Errorf("Expected page to contain\n%s\nbut got\n%s", expected, out)
+	}
+	if strings.Contains(out, "literate-source.css") || strings.Contains(out, "theme.css") {
+		t.Errorf("Expected no links to inlined stylesheets but got\n%s", out)
+	}
+
+	// We don't need our stylesheet file
+	if err := writeStylesheet(&d.doc); err != nil {
+		t.Fatalf("Error writing stylesheet: %s", err.Error())
+	}
+	if _, ok := d.outputs["out/literate-source.css"]; ok {
+		t.Errorf("Expected no stylesheet file to be written")
+	}
+}
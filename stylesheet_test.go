@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteStylesheet(t *testing.T) {
+	d := newBuilderDoc(newDoc())
+	d.docOutDir = "out"
+
+	if err := writeStylesheet(&d.doc); err != nil {
+		t.Fatalf("Error writing stylesheet: %s", err.Error())
+	}
+
+	css, ok := d.outputs["out/literate-source.css"]
+	if !ok {
+		t.Fatalf("Expected stylesheet to be written, but got %#v", d.outputs)
+	}
+	lines := strings.SplitN(css.String(), "\n", 2)
+	if lines[0] != stylesheetHeader(builtinStylesheet) || lines[1] != builtinStylesheet {
+		t.Errorf("Expected our stylesheet with its header but got\n%s", css.String())
+	}
+	for _, sub := range []string{
+		".chunk-name {",
+		".chunk-refs, .chunk-idents {",
+		"@media print {",
+		"@media (prefers-color-scheme: dark) {",
+	} {
+		if !strings.Contains(css.String(), sub) {
+			t.Errorf("Expected stylesheet to contain %q", sub)
+		}
+	}
+}
+
+func TestWriteStylesheet_Overwriting(t *testing.T) {
+	current := stylesheetHeader(builtinStylesheet) + "\n" + builtinStylesheet
+	oldHashed := stylesheetHeader(".old {}\n") + "\n.old {}\n"
+	changed := stylesheetHeader(builtinStylesheet) + "\n" +
+		builtinStylesheet + "pre { color: red; }\n"
+
+	data := []struct {
+		existing  string
+		overwrite bool
+	}{
+		{current, true},
+		{oldHashed, true},
+		{oldStylesheets[0], true},
+		{oldStylesheets[1], true},
+		{changed, false},
+		{"body { color: red; }\n", false},
+		{"", false},
+	}
+
+	for _, dt := range data {
+		d := newDoc()
+		d.docOutDir = "out"
+		written := false
+		d.outReader = func(name string) (io.ReadCloser, error) {
+			return stringReadCloser{strings.NewReader(dt.existing)}, nil
+		}
+		d.writeCloser = func(name string) (io.WriteCloser, error) {
+			written = true
+			return builderWriteCloser{&strings.Builder{}}, nil
+		}
+
+		if err := writeStylesheet(&d); err != nil {
+			t.Fatalf("Error writing stylesheet: %s", err.Error())
+		}
+		if written != dt.overwrite {
+			t.Errorf("Existing stylesheet %q: Expected overwriting to be %v but got %v",
+				dt.existing, dt.overwrite, written)
+		}
+	}
+}
+
+func TestWriteStylesheet_NotBuiltin(t *testing.T) {
+	d := newBuilderDoc(newDoc())
+	d.builtinCSS = false
+
+	if err := writeStylesheet(&d.doc); err != nil {
+		t.Fatalf("Error writing stylesheet: %s", err.Error())
+	}
+	if len(d.outputs) != 0 {
+		t.Errorf("Expected no stylesheet but got %#v", d.outputs)
+	}
+}
+
+func TestStylesheetLinks(t *testing.T) {
+	d := newDoc()
+	d.docOutDir = "out"
+	d.stylesheets = []string{
+		"theme.css",
+		"css/extra.css",
+		"/site.css",
+		"https://example.com/fonts.css",
+	}
+
+	data := []struct {
+		builtin bool
+		outName string
+		exp     []string
+	}{
+		{true, "out/book.html", []string{
+			"literate-source.css",
+			"theme.css",
+			"css/extra.css",
+			"/site.css",
+			"https://example.com/fonts.css",
+		}},
+		{true, "out/ch/one.html", []string{
+			"../literate-source.css",
+			"../theme.css",
+			"../css/extra.css",
+			"/site.css",
+			"https://example.com/fonts.css",
+		}},
+		{false, "out/ch/one.html", []string{
+			"../theme.css",
+			"../css/extra.css",
+			"/site.css",
+			"https://example.com/fonts.css",
+		}},
+	}
+
+	for _, dt := range data {
+		d.builtinCSS = dt.builtin
+		act := d.stylesheetLinks(dt.outName)
+		if !reflect.DeepEqual(act, dt.exp) {
+			t.Errorf("Builtin %v, out name %s: Expected %q but got %q",
+				dt.builtin, dt.outName, dt.exp, act)
+		}
+	}
+}
+
+func TestWriteHTML_Stylesheets(t *testing.T) {
+	d := newBuilderDoc(newDoc())
+	d.outNames["book.md"] = "book.html"
+	d.markdown["book.md"] = &strings.Builder{}
+	d.markdown["book.md"].WriteString("Hello\n")
+	d.stylesheets = []string{"theme.css"}
+
+	if err := writeHTML("book.md", "book.html", &d.doc); err != nil {
+		t.Fatalf("Error writing HTML: %s", err.Error())
+	}
+	expected := "<link href=\"literate-source.css\" rel=\"stylesheet\"/>\n" +
+		"    <link href=\"theme.css\" rel=\"stylesheet\"/>\n" +
+		"    </head>"
+	if out := d.outputs["book.html"].String(); !strings.Contains(out, expected) {
+		t.Errorf("Expected page to contain\n%s\nbut got\n%s", expected, out)
+	}
+
+	d.builtinCSS = false
+	d.stylesheets = []string{}
+	if err := writeHTML("book.md", "book.html", &d.doc); err != nil {
+		t.Fatalf("Error writing HTML: %s", err.Error())
+	}
+	if out := d.outputs["book.html"].String(); strings.Contains(out, "<link") {
+		t.Errorf("Expected page to have no stylesheets but got\n%s", out)
+	}
+}
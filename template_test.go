@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func templateTestDoc(t *testing.T) builderDoc {
+	data := map[string]string{
+		"book.md": "# The book\n" +
+			"* [One](ch/one.md)\n" +
+			"* [Two](two.md)\n",
+		"ch/one.md": "Carrying on\n" +
+			"## One\n" +
+			"### Deeper {-}\n",
+		"two.md": "---\n" +
+			"title: Chapter two\n" +
+			"---\n" +
+			"# Two\n",
+	}
+
+	s := newState()
+	s.setFirstInName("book.md")
+	s.book = "book.md"
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		return stringReadCloser{strings.NewReader(data[fName])}, nil
+	}
+	d := newBuilderDoc(newDoc())
+	d.docOutDir = "out"
+	d.title = "Everything"
+
+	if err := firstPassForAll(&s, &d.doc); err != nil {
+		t.Fatalf("Error on first pass for all: %s", err.Error())
+	}
+	d.lat = compileLattice(d.chunks)
+	return d
+}
+
+func TestPageFor(t *testing.T) {
+	d := templateTestDoc(t)
+
+	page := d.pageFor("ch/one.md", "out/ch/one.html")
+
+	if page.Title != "Everything" || page.BookTitle != "Everything" {
+		t.Errorf("Expected title and book title Everything but got %q and %q",
+			page.Title, page.BookTitle)
+	}
+	expSections := []pageSection{
+		{"1.1", "One", 2, "#section-1.1"},
+		{"", "Deeper", 3, "#section-1.1.1"},
+	}
+	if !reflect.DeepEqual(page.Sections, expSections) {
+		t.Errorf("Expected sections %#v but got %#v", expSections, page.Sections)
+	}
+	expPrev := &pageLink{"The book", "../book.html"}
+	if !reflect.DeepEqual(page.Prev, expPrev) {
+		t.Errorf("Expected previous page %#v but got %#v", expPrev, page.Prev)
+	}
+	expNext := &pageLink{"Chapter two", "../two.html"}
+	if !reflect.DeepEqual(page.Next, expNext) {
+		t.Errorf("Expected next page %#v but got %#v", expNext, page.Next)
+	}
+
+	page = d.pageFor("book.md", "out/book.html")
+	if page.Prev != nil || page.Next.Link != "ch/one.html" || page.Next.Title != "One" {
+		t.Errorf("Expected only a next page, to ch/one.html, but got %#v and %#v",
+			page.Prev, page.Next)
+	}
+	if len(page.Sections) != 1 || page.Sections[0].Title != "The book" {
+		t.Errorf("Expected just the one section but got %#v", page.Sections)
+	}
+}
+
+func TestPageFor_Navigation(t *testing.T) {
+	d := templateTestDoc(t)
+
+	data := []struct {
+		inName     string
+		outName    string
+		contents   *pageLink
+		breadcrumb []pageLink
+	}{
+		{"book.md", "out/book.html",
+			&pageLink{"Contents", "contents.html"},
+			[]pageLink{{"1 The book", "#section-1"}}},
+		{"ch/one.md", "out/ch/one.html",
+			&pageLink{"Contents", "../contents.html"},
+			[]pageLink{{"The book", "../book.html"}, {"1.1 One", "#section-1.1"}}},
+		{"two.md", "out/two.html",
+			&pageLink{"Contents", "contents.html"},
+			[]pageLink{{"The book", "book.html"}, {"2 Two", "#section-2"}}},
+	}
+
+	for _, dt := range data {
+		page := d.pageFor(dt.inName, dt.outName)
+		if !reflect.DeepEqual(page.Contents, dt.contents) {
+			t.Errorf("%s: Expected contents %#v but got %#v",
+				dt.inName, dt.contents, page.Contents)
+		}
+		if !reflect.DeepEqual(page.Breadcrumb, dt.breadcrumb) {
+			t.Errorf("%s: Expected breadcrumb %#v but got %#v",
+				dt.inName, dt.breadcrumb, page.Breadcrumb)
+		}
+	}
+
+	// Our own pages
+	page := d.extraPageFor("out/contents.html", "Contents")
+	expCrumbs := []pageLink{{"The book", "book.html"}, {"Contents", "contents.html"}}
+	if page.Contents != nil || !reflect.DeepEqual(page.Breadcrumb, expCrumbs) {
+		t.Errorf("Expected no contents link and breadcrumb %#v but got %#v and %#v",
+			expCrumbs, page.Contents, page.Breadcrumb)
+	}
+	page = d.extraPageFor("out/chunk-index.html", "Chunk index")
+	if !reflect.DeepEqual(page.Contents, &pageLink{"Contents", "contents.html"}) {
+		t.Errorf("Expected link to contents but got %#v", page.Contents)
+	}
+
+	// Without a contents page, the first file is the contents
+	d.outNames["book.md"] = "out/contents.html"
+	page = d.pageFor("two.md", "out/two.html")
+	if !reflect.DeepEqual(page.Contents, &pageLink{"The book", "contents.html"}) {
+		t.Errorf("Expected link to the first file but got %#v", page.Contents)
+	}
+}
+
+func TestWriteHTML_DefaultTemplate(t *testing.T) {
+	d := templateTestDoc(t)
+
+	if err := writeHTML("ch/one.md", "out/ch/one.html", &d.doc); err != nil {
+		t.Fatalf("Error writing HTML: %s", err.Error())
+	}
+
+	out := d.outputs["out/ch/one.html"].String()
+	nav := "<nav class=\"page-nav\">\n" +
+		"    <span class=\"breadcrumb\"><a href=\"../book.html\">The book</a> &rsaquo; " +
+		"<a href=\"#section-1.1\">1.1 One</a></span>\n" +
+		"    <span class=\"nav-links\"><a rel=\"prev\" href=\"../book.html\">&larr; The book</a> " +
+		"<a rel=\"contents\" href=\"../contents.html\">Contents</a> " +
+		"<a rel=\"next\" href=\"../two.html\">Chapter two &rarr;</a></span>\n" +
+		"    </nav>\n" +
+		"    "
+	expStart := "<html><head>\n" +
+		"    <title>Everything</title>\n" +
+		"    <link href=\"../literate-source.css\" rel=\"stylesheet\"/>\n" +
+		"    </head>\n" +
+		"    <body>" + nav + "<p><a name=\"section-1\"></a>\n"
+	if !strings.HasPrefix(out, expStart) {
+		t.Errorf("Expected output to start\n%s\nbut got\n%s", expStart, out)
+	}
+	if !strings.HasSuffix(out, "</h3>\n"+nav+"</body></html>") {
+		t.Errorf("Expected output to end with the body and nav but got\n%s", out)
+	}
+}
+
+func TestWriteHTML_DefaultTemplateOneFile(t *testing.T) {
+	d := newBuilderDoc(newDoc())
+	d.inNames = []string{"book.md"}
+	d.outNames["book.md"] = "book.html"
+	d.markdown["book.md"] = &strings.Builder{}
+	d.markdown["book.md"].WriteString("# Hello\n")
+
+	if err := writeHTML("book.md", "book.html", &d.doc); err != nil {
+		t.Fatalf("Error writing HTML: %s", err.Error())
+	}
+
+	out := d.outputs["book.html"].String()
+	if strings.Contains(out, "<nav") {
+		t.Errorf("Expected no navigation for one file but got\n%s", out)
+	}
+}
+
+func TestWriteHTML_CustomTemplate(t *testing.T) {
+	d := templateTestDoc(t)
+	s := newState()
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		if fName != "page.tmpl" {
+			return nil, fmt.Errorf("No such file %s", fName)
+		}
+		return stringReadCloser{strings.NewReader(
+			"<h1>{{.BookTitle}}: {{.Title}}</h1>\n" +
+				"{{range .Sections}}<li class=\"level-{{.Level}}\">" +
+				"<a href=\"{{.Link}}\">{{.Number}} {{.Title}}</a></li>\n{{end}}" +
+				"{{with .Prev}}<a rel=\"prev\" href=\"{{.Link}}\">{{.Title}}</a>\n{{end}}" +
+				"{{with .Next}}<a rel=\"next\" href=\"{{.Link}}\">{{.Title}}</a>\n{{end}}" +
+				"<link href=\"{{.Stylesheet}}\"/>\n" +
+				"{{.Body}}")}, nil
+	}
+	tmpl, err := s.readTemplate("page.tmpl")
+	if err != nil {
+		t.Fatalf("Error reading template: %s", err.Error())
+	}
+	d.template = tmpl
+	d.title = "Fish & chips"
+
+	if err := writeHTML("two.md", "out/two.html", &d.doc); err != nil {
+		t.Fatalf("Error writing HTML: %s", err.Error())
+	}
+
+	out := d.outputs["out/two.html"].String()
+	expected := "<h1>Fish &amp; chips: Chapter two</h1>\n" +
+		"<li class=\"level-1\"><a href=\"#section-2\">2 Two</a></li>\n" +
+		"<a rel=\"prev\" href=\"ch/one.html\">One</a>\n" +
+		"<link href=\"literate-source.css\"/>\n"
+	if !strings.HasPrefix(out, expected) {
+		t.Errorf("Expected output to start\n%s\nbut got\n%s", expected, out)
+	}
+	if !strings.Contains(out, "<h1><a name=\"section-2\"></a>2 Two</h1>\n") {
+		t.Errorf("Expected output to contain the body but got\n%s", out)
+	}
+
+	// Other pages use the template, too
+	if err := writeContents(&d.doc); err != nil {
+		t.Fatalf("Error writing contents: %s", err.Error())
+	}
+	out = d.outputs["out/contents.html"].String()
+	if !strings.HasPrefix(out, "<h1>Fish &amp; chips: Contents</h1>\n<link href") {
+		t.Errorf("Expected contents page to use the template but got\n%s", out)
+	}
+}
+
+func TestProcForTemplateDirective(t *testing.T) {
+	s := newState()
+	s.setFirstInName("docs/book.md")
+	s.reader = func(fName string) (io.ReadCloser, error) {
+		switch fName {
+		case "docs/tmpl/page.tmpl":
+			return stringReadCloser{strings.NewReader("<p>{{.Title}}</p>")}, nil
+		case "docs/bad.tmpl":
+			return stringReadCloser{strings.NewReader("<p>{{.Title</p>")}, nil
+		}
+		return nil, fmt.Errorf("No such file %s", fName)
+	}
+	d := newDoc()
+
+	s.proc(&s, &d, "@template tmpl/page.tmpl")
+	if d.template == nil || d.template.Name() != "page.tmpl" {
+		t.Errorf("Expected template from docs/tmpl/page.tmpl but got %#v", d.template)
+	}
+
+	s.proc(&s, &d, "@template bad.tmpl")
+	s.proc(&s, &d, "@template missing.tmpl")
+	if len(s.warnings) != 2 || s.warnings[0].line != 2 || s.warnings[1].line != 3 {
+		t.Errorf("Expected warnings at lines 2 and 3 but got %#v", s.warnings)
+	}
+	if d.template.Name() != "page.tmpl" {
+		t.Errorf("Expected bad templates not to replace the good one")
+	}
+}
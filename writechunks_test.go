@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"io"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
@@ -22,6 +23,13 @@ func newBuilderDoc(d doc) builderDoc {
 		return builderWriteCloser{b}, nil
 	}
 	d.writeCloser = wc
+	d.outReader = func(name string) (io.ReadCloser, error) {
+		b, ok := outputs[name]
+		if !ok {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		return stringReadCloser{strings.NewReader(b.String())}, nil
+	}
 	return builderDoc{d, outputs}
 }
 
@@ -611,3 +619,50 @@ func TestLineDirective(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteChunks_CommentStyle(t *testing.T) {
+	// Test code that looks like this (with line numbers):
+	//
+	// ``` One      1
+	// Line 1.1     2
+	//   @{Two}     3
+	// ```
+	// ``` Two      5
+	// Line 2.1     6
+	// ```
+
+	expected := `// One
+Line 1.1
+  // Two
+  Line 2.1
+`
+
+	top := []string{"One"}
+	chunks := map[string]*chunk{
+		"One": &chunk{
+			defLines(1),
+			[]chunkCont{
+				contLNumCode(2, "Line 1.1"),
+				contLNumCode(3, "  @{Two}")},
+		},
+		"Two": &chunk{
+			defLines(5),
+			[]chunkCont{
+				contLNumCode(6, "Line 2.1")},
+		},
+	}
+
+	d := newBuilderDoc(doc{
+		chunks:       chunks,
+		commentStyle: "// %s",
+	})
+	if err := d.writeChunks(top, "test.md"); err != nil {
+		t.Errorf("Should not have produced an error, but got %q",
+			err.Error())
+	}
+
+	if d.outputs["One"].String() != expected {
+		t.Errorf("Expected\n%q\nbut got\n%q",
+			expected, d.outputs["One"].String())
+	}
+}